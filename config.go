@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rxmeez/chirpy/internal/database"
+)
+
+type dbConfig struct {
+	driver string
+	path   string
+	opts   database.Options
+}
+
+// dbConfigFromEnv reads the DB_* settings. Everything is optional; the
+// defaults give a persistent JSON store at ./database.json.
+func dbConfigFromEnv() (dbConfig, error) {
+	cfg := dbConfig{
+		driver: os.Getenv("DB_DRIVER"),
+		path:   os.Getenv("DB_PATH"),
+	}
+
+	if cfg.path == "" {
+		cfg.path = "./database.json"
+		if cfg.driver == "sqlite" {
+			cfg.path = "./database.sqlite"
+		}
+	}
+
+	var err error
+	cfg.opts.Mode, err = database.ParseMode(os.Getenv("DB_MODE"))
+	if err != nil {
+		return dbConfig{}, err
+	}
+
+	if v := os.Getenv("DB_WAL"); v != "" {
+		cfg.opts.WriteAheadLog, err = strconv.ParseBool(v)
+		if err != nil {
+			return dbConfig{}, fmt.Errorf("Couldn't parse DB_WAL: %w", err)
+		}
+	}
+
+	cfg.opts.Durability, err = database.ParseDurability(os.Getenv("DB_DURABILITY"))
+	if err != nil {
+		return dbConfig{}, err
+	}
+
+	if v := os.Getenv("DB_FLUSH_INTERVAL"); v != "" {
+		cfg.opts.FlushInterval, err = time.ParseDuration(v)
+		if err != nil {
+			return dbConfig{}, fmt.Errorf("Couldn't parse DB_FLUSH_INTERVAL: %w", err)
+		}
+	}
+
+	return cfg, nil
+}
+
+type backupConfig struct {
+	dir       string
+	retention int
+}
+
+// backupConfigFromEnv reads BACKUP_DIR (default ./backups) and
+// BACKUP_RETENTION, the number of snapshots to keep (default 7, 0 keeps all).
+func backupConfigFromEnv() (backupConfig, error) {
+	cfg := backupConfig{
+		dir:       os.Getenv("BACKUP_DIR"),
+		retention: 7,
+	}
+
+	if cfg.dir == "" {
+		cfg.dir = "./backups"
+	}
+
+	if v := os.Getenv("BACKUP_RETENTION"); v != "" {
+		retention, err := strconv.Atoi(v)
+		if err != nil {
+			return backupConfig{}, fmt.Errorf("Couldn't parse BACKUP_RETENTION: %w", err)
+		}
+		cfg.retention = retention
+	}
+
+	return cfg, nil
+}
+
+// sessionSweepIntervalFromEnv reads SESSION_SWEEP_INTERVAL, how often
+// expired sessions are purged (default 1h).
+func sessionSweepIntervalFromEnv() (time.Duration, error) {
+	v := os.Getenv("SESSION_SWEEP_INTERVAL")
+	if v == "" {
+		return time.Hour, nil
+	}
+
+	interval, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't parse SESSION_SWEEP_INTERVAL: %w", err)
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("SESSION_SWEEP_INTERVAL must be positive, got %s", v)
+	}
+	return interval, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/rxmeez/chirpy/internal/auth"
+)
+
+// authorizeAdmin checks the request carries ADMIN_API_KEY, responding with
+// 401 if it doesn't.
+func (cfg *apiConfig) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	apiKey, err := auth.GetApiKey(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find admin ApiKey")
+		return false
+	}
+
+	if cfg.adminApiKey == "" || subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.adminApiKey)) != 1 {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized admin apikey")
+		return false
+	}
+	return true
+}
+
+func (cfg *apiConfig) handlerAdminBackup(w http.ResponseWriter, r *http.Request) {
+
+	type response struct {
+		File string `json:"file"`
+	}
+
+	if !cfg.authorizeAdmin(w, r) {
+		return
+	}
+
+	file, err := cfg.db.Backup(cfg.backupDir, cfg.backupRetention)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write backup")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		File: file,
+	})
+}
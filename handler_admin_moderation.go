@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rxmeez/chirpy/internal/database"
+)
+
+func (cfg *apiConfig) handlerModerationReload(w http.ResponseWriter, r *http.Request) {
+
+	type response struct {
+		Rules int `json:"rules"`
+	}
+
+	if !cfg.authorizeAdmin(w, r) {
+		return
+	}
+
+	err := cfg.moderator.Reload()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reload moderation rules: "+err.Error())
+		return
+	}
+
+	rules := cfg.moderator.Rules().Len()
+	log.Printf("Reloaded %d moderation rules", rules)
+	respondWithJSON(w, http.StatusOK, response{
+		Rules: rules,
+	})
+}
+
+// handlerModerationFlags lists the chirps held for review, ordered by chirp id.
+func (cfg *apiConfig) handlerModerationFlags(w http.ResponseWriter, r *http.Request) {
+
+	type flag struct {
+		ChirpId   int       `json:"chirp_id"`
+		Rules     []string  `json:"rules"`
+		FlaggedAt time.Time `json:"flagged_at"`
+		Chirp     Chirp     `json:"chirp"`
+	}
+
+	if !cfg.authorizeAdmin(w, r) {
+		return
+	}
+
+	dbFlags, err := cfg.db.GetFlags()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve flags")
+		return
+	}
+
+	flags := []flag{}
+	for _, dbFlag := range dbFlags {
+		chirp, err := cfg.db.GetChirp(dbFlag.ChirpId)
+		if errors.Is(err, database.ErrorChirpDoesNotExist) {
+			// Deleted since GetFlags, taking its flag with it.
+			continue
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve chirps")
+			return
+		}
+		flags = append(flags, flag{
+			ChirpId:   dbFlag.ChirpId,
+			Rules:     dbFlag.Rules,
+			FlaggedAt: dbFlag.FlaggedAt,
+			Chirp:     chirpFromDatabase(chirp),
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, flags)
+}
+
+// handlerModerationDismiss clears a chirp's flag once it has been reviewed.
+func (cfg *apiConfig) handlerModerationDismiss(w http.ResponseWriter, r *http.Request) {
+
+	if !cfg.authorizeAdmin(w, r) {
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp id")
+		return
+	}
+
+	err = cfg.db.FlagChirp(id, nil)
+	if errors.Is(err, database.ErrorChirpDoesNotExist) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't clear flag")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -3,24 +3,82 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/rxmeez/chirpy/internal/auth"
+	"github.com/rxmeez/chirpy/internal/chirptext"
+	"github.com/rxmeez/chirpy/internal/database"
+	"github.com/rxmeez/chirpy/internal/moderation"
 )
 
 type Chirp struct {
-	Id       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorId int    `json:"author_id"`
+	Id       int      `json:"id"`
+	Body     string   `json:"body"`
+	AuthorId int      `json:"author_id"`
+	Hashtags []string `json:"hashtags"`
+	Mentions []int    `json:"mentions"`
+	// InReplyTo is omitted for chirps that start a conversation.
+	InReplyTo int  `json:"in_reply_to,omitempty"`
+	LikeCount int  `json:"like_count"`
+	LikedByMe bool `json:"liked_by_me"`
+	// RechirpOf and QuoteOf are omitted unless the chirp shares another one,
+	// which is then embedded as Original.
+	RechirpOf int          `json:"rechirp_of,omitempty"`
+	QuoteOf   int          `json:"quote_of,omitempty"`
+	Original  *SharedChirp `json:"original,omitempty"`
+	// CreatedAt and UpdatedAt are null for chirps from before they were
+	// recorded.
+	CreatedAt *time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// SharedChirp is the chirp a rechirp or quote shares. Once a quoted chirp is
+// deleted only its id is left, with deleted true.
+type SharedChirp struct {
+	Chirp
+	Deleted bool `json:"deleted"`
+}
+
+func chirpFromDatabase(chirp database.Chirp) Chirp {
+	response := Chirp{
+		Id:        chirp.Id,
+		Body:      chirp.Body,
+		AuthorId:  chirp.AuthorId,
+		Hashtags:  chirp.Tags(),
+		Mentions:  append([]int{}, chirp.Mentions...),
+		InReplyTo: chirp.InReplyTo,
+		LikeCount: chirp.LikeCount,
+		RechirpOf: chirp.RechirpOf,
+		QuoteOf:   chirp.QuoteOf,
+		CreatedAt: chirp.CreatedAt,
+		UpdatedAt: chirp.UpdatedAt,
+	}
+	if chirp.Shared != nil {
+		response.Original = &SharedChirp{Chirp: chirpFromDatabase(*chirp.Shared)}
+	} else if id := chirp.SharedId(); id != 0 {
+		response.Original = &SharedChirp{Chirp: chirpFromDatabase(database.Chirp{Id: id}), Deleted: true}
+	}
+	return response
+}
+
+func chirpsFromDatabase(dbChirps []database.Chirp) []Chirp {
+	chirps := []Chirp{}
+	for _, dbChirp := range dbChirps {
+		chirps = append(chirps, chirpFromDatabase(dbChirp))
+	}
+	return chirps
 }
 
 func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request) {
 
 	type parameters struct {
-		Body string `json:"body"`
+		Body      string `json:"body"`
+		InReplyTo int    `json:"in_reply_to"`
+		QuoteOf   int    `json:"quote_of"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -36,15 +94,20 @@ func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	userId, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userId, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.db.TokenVersion)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT")
 		return
 	}
 
-	cleaned, err := validateChirp(params.Body)
+	if params.InReplyTo != 0 && params.QuoteOf != 0 {
+		respondWithError(w, http.StatusBadRequest, "A chirp can't both reply and quote")
+		return
+	}
+
+	moderated, err := cfg.validateChirp(params.Body)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, err.Error())
+		respondWithChirpError(w, err)
 		return
 	}
 
@@ -53,45 +116,89 @@ func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request
 		log.Fatal("Failed to convert string to int authorId")
 	}
 
-	chirp, err := cfg.db.CreateChirp(cleaned, authorId)
+	var chirp database.Chirp
+	switch {
+	case params.InReplyTo != 0:
+		chirp, err = cfg.db.CreateReply(moderated.Body, authorId, params.InReplyTo)
+	case params.QuoteOf != 0:
+		chirp, err = cfg.db.CreateQuote(moderated.Body, authorId, params.QuoteOf)
+	default:
+		chirp, err = cfg.db.CreateChirp(moderated.Body, authorId)
+	}
+	if errors.Is(err, database.ErrorParentChirpDoesNotExist) || errors.Is(err, database.ErrorSharedChirpDoesNotExist) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create chirp")
 		return
 	}
+	if len(moderated.Flags) > 0 {
+		cfg.flagChirp(chirp.Id, moderated.Flags)
+	}
 
-	respondWithJSON(w, http.StatusCreated, Chirp{
-		Id:       chirp.Id,
-		Body:     chirp.Body,
-		AuthorId: chirp.AuthorId,
-	})
+	respondWithJSON(w, http.StatusCreated, chirpFromDatabase(chirp))
 
 }
 
-func validateChirp(body string) (string, error) {
-	const maxChirpLength int = 140
-	badWords := map[string]struct{}{
-		"kerfuffle": {},
-		"sharbert":  {},
-		"fornax":    {},
-	}
+const maxChirpLength int = 140
+
+// chirpTooLongError reports a chirp over the limit, both counted in
+// user-perceived characters.
+type chirpTooLongError struct {
+	Length int
+	Limit  int
+}
+
+func (e chirpTooLongError) Error() string {
+	return "Chirp is too long"
+}
+
+// respondWithChirpError responds to a chirp validateChirp refused. Too long
+// chirps also get the counted length and the limit, so clients can show
+// how much to cut.
+func respondWithChirpError(w http.ResponseWriter, err error) {
 
-	if len(body) > maxChirpLength {
-		return "", errors.New("Chirp is too long")
+	type response struct {
+		Error  string `json:"error"`
+		Length int    `json:"length"`
+		Limit  int    `json:"limit"`
 	}
 
-	cleaned := getCleanedBody(body, badWords)
-	return cleaned, nil
+	var tooLong chirpTooLongError
+	if errors.As(err, &tooLong) {
+		respondWithJSON(w, http.StatusBadRequest, response{
+			Error:  tooLong.Error(),
+			Length: tooLong.Length,
+			Limit:  tooLong.Limit,
+		})
+		return
+	}
+	respondWithError(w, http.StatusBadRequest, err.Error())
 }
 
-func getCleanedBody(body string, badWords map[string]struct{}) string {
-	words := strings.Split(body, " ")
-	for i, word := range words {
-		lowerWord := strings.ToLower(word)
-		if _, ok := badWords[lowerWord]; ok {
-			words[i] = "****"
-		}
+// validateChirp normalises body, then checks it against the length limit
+// and the moderation rules. The result's body is what should be stored; its
+// flags should be recorded with FlagChirp once the chirp is.
+func (cfg *apiConfig) validateChirp(body string) (moderation.Result, error) {
+	body = chirptext.Normalize(body)
+
+	if length := chirptext.Length(body); length > maxChirpLength {
+		return moderation.Result{}, chirpTooLongError{Length: length, Limit: maxChirpLength}
+	}
+
+	result := cfg.moderator.Check(body)
+	if result.Rejected != "" {
+		return moderation.Result{}, fmt.Errorf("Chirp was rejected by moderation rule %q", result.Rejected)
 	}
-	cleaned := strings.Join(words, " ")
-	return cleaned
+	return result, nil
+}
 
+// flagChirp records the flags of a chirp that is already stored, so a
+// failure is logged rather than failing the request.
+func (cfg *apiConfig) flagChirp(chirpId int, flags []string) {
+	err := cfg.db.FlagChirp(chirpId, flags)
+	if err != nil {
+		log.Printf("Couldn't flag chirp %d: %v", chirpId, err)
+	}
 }
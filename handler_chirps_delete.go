@@ -21,7 +21,7 @@ func (cfg *apiConfig) handlerChirpDeleteId(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	userId, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userId, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.db.TokenVersion)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT")
 		return
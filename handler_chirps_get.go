@@ -2,65 +2,122 @@ package main
 
 import (
 	"errors"
-	"log"
+	"fmt"
 	"net/http"
-	"sort"
 	"strconv"
+	"time"
 
 	"github.com/rxmeez/chirpy/internal/database"
 )
 
 func (cfg *apiConfig) handlerChirpsRetrieve(w http.ResponseWriter, r *http.Request) {
 
-	dbChirps, err := cfg.db.GetChirps()
-	if err != nil && !errors.Is(err, database.ErrorEmptyFile) {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve chirps")
+	query, err := parseChirpQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	chirps := []Chirp{}
-
 	authorId := r.URL.Query().Get("author_id")
 	if authorId != "" {
-		for _, dbChirp := range dbChirps {
-			authorIdInt, err := strconv.Atoi(authorId)
-			if err != nil {
-				log.Fatal("Unable to convert authorId string to int")
-				return
-			}
-			if authorIdInt == dbChirp.AuthorId {
-				chirps = append(chirps, Chirp{
-					Id:       dbChirp.Id,
-					Body:     dbChirp.Body,
-					AuthorId: dbChirp.AuthorId,
-				})
-			}
-		}
-	} else {
-		for _, dbChirp := range dbChirps {
-			chirps = append(chirps, Chirp{
-				Id:       dbChirp.Id,
-				Body:     dbChirp.Body,
-				AuthorId: dbChirp.AuthorId,
-			})
+		query.AuthorId, err = strconv.Atoi(authorId)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid author_id")
+			return
 		}
 	}
 
-	sorter := "asc"
-	if r.URL.Query().Get("sort") == "desc" {
-		sorter = "desc"
+	page, err := cfg.db.GetChirps(query)
+	if errors.Is(err, database.ErrorInvalidCursor) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve chirps")
+		return
 	}
 
-	sort.Slice(chirps, func(i, j int) bool {
-		if sorter == "asc" {
-			return chirps[i].Id < chirps[j].Id
-		}
-		return chirps[i].Id > chirps[j].Id
-	})
+	chirps := chirpsFromDatabase(page.Chirps)
+	err = cfg.markLiked(r, chirpRefs(chirps))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve likes")
+		return
+	}
 
+	setNextLink(w, r, page.NextCursor)
 	respondWithJSON(w, http.StatusOK, chirps)
 }
 
+// parseChirpQuery reads the sort, limit, cursor, since and until parameters
+// shared by the chirp listing endpoints.
+func parseChirpQuery(r *http.Request) (database.ChirpQuery, error) {
+	query := database.ChirpQuery{
+		Sort:   database.SortAsc,
+		Cursor: r.URL.Query().Get("cursor"),
+	}
+
+	switch sorter := r.URL.Query().Get("sort"); sorter {
+	case "", "asc":
+	case "desc":
+		query.Sort = database.SortDesc
+	case "likes":
+		query.Sort = database.SortLikes
+	case "created_at":
+		query.Sort = database.SortCreatedAt
+	default:
+		return database.ChirpQuery{}, fmt.Errorf("Unknown sort %q", sorter)
+	}
+
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		limitInt, err := strconv.Atoi(limit)
+		if err != nil || limitInt < 1 || limitInt > database.MaxChirpLimit {
+			return database.ChirpQuery{}, fmt.Errorf("limit must be between 1 and %d", database.MaxChirpLimit)
+		}
+		query.Limit = limitInt
+	}
+
+	var err error
+	query.Since, err = parseTimeParam(r, "since")
+	if err != nil {
+		return database.ChirpQuery{}, err
+	}
+	query.Until, err = parseTimeParam(r, "until")
+	if err != nil {
+		return database.ChirpQuery{}, err
+	}
+
+	return query, nil
+}
+
+// parseTimeParam reads an optional RFC 3339 time from the query string. A
+// missing parameter is the zero time.
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 time", name)
+	}
+	return t, nil
+}
+
+// setNextLink points the client at the next page with a Link header, keeping
+// every other query parameter of the current request.
+func setNextLink(w http.ResponseWriter, r *http.Request, nextCursor string) {
+	if nextCursor == "" {
+		return
+	}
+
+	next := *r.URL
+	values := next.Query()
+	values.Set("cursor", nextCursor)
+	next.RawQuery = values.Encode()
+
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+}
+
 func (cfg *apiConfig) handlerChirpRetrieveId(w http.ResponseWriter, r *http.Request) {
 
 	id, err := strconv.Atoi(r.PathValue("id"))
@@ -74,6 +131,13 @@ func (cfg *apiConfig) handlerChirpRetrieveId(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, chirp)
+	response := chirpFromDatabase(chirp)
+	err = cfg.markLiked(r, response.appendRefs(nil))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve likes")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
 
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/rxmeez/chirpy/internal/auth"
+	"github.com/rxmeez/chirpy/internal/database"
+)
+
+func (cfg *apiConfig) handlerChirpLike(w http.ResponseWriter, r *http.Request) {
+	cfg.handleLikeChange(w, r, cfg.db.LikeChirp)
+}
+
+func (cfg *apiConfig) handlerChirpUnlike(w http.ResponseWriter, r *http.Request) {
+	cfg.handleLikeChange(w, r, cfg.db.UnlikeChirp)
+}
+
+// handleLikeChange applies change to the chirp in the path and the
+// authenticated user.
+func (cfg *apiConfig) handleLikeChange(w http.ResponseWriter, r *http.Request, change func(chirpId int, userId int) error) {
+
+	chirpId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp id")
+		return
+	}
+
+	userId, ok := cfg.authenticatedUserId(w, r)
+	if !ok {
+		return
+	}
+
+	err = change(chirpId, userId)
+	if errors.Is(err, database.ErrorChirpDoesNotExist) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrorUserNotFound) {
+		respondWithError(w, http.StatusUnauthorized, "User not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update like")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// markLiked sets LikedByMe on the chirps the user r is authenticated as
+// likes. Reading chirps needs no login, so without a valid token every
+// chirp is left unliked.
+func (cfg *apiConfig) markLiked(r *http.Request, chirps []*Chirp) error {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return nil
+	}
+	userIdString, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.db.TokenVersion)
+	if err != nil {
+		return nil
+	}
+	userId, err := strconv.Atoi(userIdString)
+	if err != nil {
+		return nil
+	}
+
+	ids := make([]int, 0, len(chirps))
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.Id)
+	}
+	liked, err := cfg.db.LikedChirps(userId, ids)
+	if err != nil {
+		return err
+	}
+	for _, chirp := range chirps {
+		chirp.LikedByMe = liked[chirp.Id]
+	}
+	return nil
+}
+
+func chirpRefs(chirps []Chirp) []*Chirp {
+	refs := make([]*Chirp, 0, len(chirps))
+	for i := range chirps {
+		refs = chirps[i].appendRefs(refs)
+	}
+	return refs
+}
+
+// appendRefs appends c and the original it embeds to refs.
+func (c *Chirp) appendRefs(refs []*Chirp) []*Chirp {
+	refs = append(refs, c)
+	if c.Original != nil && !c.Original.Deleted {
+		refs = append(refs, &c.Original.Chirp)
+	}
+	return refs
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/rxmeez/chirpy/internal/database"
+)
+
+func (cfg *apiConfig) handlerChirpRechirp(w http.ResponseWriter, r *http.Request) {
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp id")
+		return
+	}
+
+	authorId, ok := cfg.authenticatedUserId(w, r)
+	if !ok {
+		return
+	}
+
+	chirp, err := cfg.db.CreateRechirp(authorId, id)
+	if errors.Is(err, database.ErrorSharedChirpDoesNotExist) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrorAlreadyRechirped) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't rechirp")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, chirpFromDatabase(chirp))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/rxmeez/chirpy/internal/database"
+)
+
+func (cfg *apiConfig) handlerChirpsSearch(w http.ResponseWriter, r *http.Request) {
+
+	query := database.SearchQuery{
+		Query: r.URL.Query().Get("q"),
+	}
+
+	authorId := r.URL.Query().Get("author_id")
+	if authorId != "" {
+		var err error
+		query.AuthorId, err = strconv.Atoi(authorId)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid author_id")
+			return
+		}
+	}
+
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		limitInt, err := strconv.Atoi(limit)
+		if err != nil || limitInt < 1 || limitInt > database.MaxChirpLimit {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", database.MaxChirpLimit))
+			return
+		}
+		query.Limit = limitInt
+	}
+
+	dbChirps, err := cfg.db.SearchChirps(query)
+	if errors.Is(err, database.ErrorEmptySearch) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't search chirps")
+		return
+	}
+
+	chirps := chirpsFromDatabase(dbChirps)
+	err = cfg.markLiked(r, chirpRefs(chirps))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve likes")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, chirps)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/rxmeez/chirpy/internal/database"
+)
+
+// threadNode is a chirp with the replies to it. A chirp that was deleted
+// but still has replies is kept as a placeholder with only its id set and
+// deleted true.
+type threadNode struct {
+	Chirp
+	Deleted bool `json:"deleted"`
+	// ReplyCount tells clients there is more to fetch when a node at the
+	// depth limit comes back with no replies.
+	ReplyCount int          `json:"reply_count"`
+	Replies    []threadNode `json:"replies"`
+}
+
+func threadFromDatabase(node database.ThreadNode) threadNode {
+	thread := threadNode{
+		Chirp:      chirpFromDatabase(node.Chirp),
+		Deleted:    node.Deleted,
+		ReplyCount: node.ReplyCount,
+		Replies:    []threadNode{},
+	}
+	for _, reply := range node.Replies {
+		thread.Replies = append(thread.Replies, threadFromDatabase(reply))
+	}
+	return thread
+}
+
+// chirpRefs appends the live chirps in the thread to refs.
+func (node *threadNode) chirpRefs(refs []*Chirp) []*Chirp {
+	if !node.Deleted {
+		refs = node.Chirp.appendRefs(refs)
+	}
+	for i := range node.Replies {
+		refs = node.Replies[i].chirpRefs(refs)
+	}
+	return refs
+}
+
+func (cfg *apiConfig) handlerChirpThread(w http.ResponseWriter, r *http.Request) {
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp id")
+		return
+	}
+
+	depth := 0
+	if depthParam := r.URL.Query().Get("depth"); depthParam != "" {
+		depth, err = strconv.Atoi(depthParam)
+		if err != nil || depth < 1 || depth > database.MaxThreadDepth {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("depth must be between 1 and %d", database.MaxThreadDepth))
+			return
+		}
+	}
+
+	thread, err := cfg.db.GetThread(id, depth)
+	if errors.Is(err, database.ErrorChirpDoesNotExist) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve thread")
+		return
+	}
+
+	response := threadFromDatabase(thread)
+	err = cfg.markLiked(r, response.chirpRefs(nil))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve likes")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rxmeez/chirpy/internal/auth"
+	"github.com/rxmeez/chirpy/internal/database"
+)
+
+func (cfg *apiConfig) handlerChirpUpdate(w http.ResponseWriter, r *http.Request) {
+
+	type parameters struct {
+		Body string `json:"body"`
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp id")
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT")
+		return
+	}
+
+	subject, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.db.TokenVersion)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT")
+		return
+	}
+
+	authorId, err := strconv.Atoi(subject)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't parse user ID")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	moderated, err := cfg.validateChirp(params.Body)
+	if err != nil {
+		respondWithChirpError(w, err)
+		return
+	}
+
+	chirp, err := cfg.db.UpdateChirp(id, authorId, moderated.Body)
+	if errors.Is(err, database.ErrorChirpDoesNotExist) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrorNotChirpAuthor) {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrorCannotEditRechirp) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update chirp")
+		return
+	}
+	// Flags follow the current body, so an edit that no longer matches a
+	// flag rule clears them.
+	cfg.flagChirp(chirp.Id, moderated.Flags)
+
+	response := chirpFromDatabase(chirp)
+	err = cfg.markLiked(r, response.appendRefs(nil))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve likes")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) handlerChirpRevisions(w http.ResponseWriter, r *http.Request) {
+
+	// Revision numbers count up from 1 for the body the chirp was posted
+	// with.
+	type revision struct {
+		Revision   int       `json:"revision"`
+		Body       string    `json:"body"`
+		ReplacedAt time.Time `json:"replaced_at"`
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp id")
+		return
+	}
+
+	dbRevisions, err := cfg.db.GetRevisions(id)
+	if errors.Is(err, database.ErrorChirpDoesNotExist) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve revisions")
+		return
+	}
+
+	revisions := []revision{}
+	for i, dbRevision := range dbRevisions {
+		revisions = append(revisions, revision{
+			Revision:   i + 1,
+			Body:       dbRevision.Body,
+			ReplacedAt: dbRevision.ReplacedAt,
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, revisions)
+}
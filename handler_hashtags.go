@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rxmeez/chirpy/internal/database"
+)
+
+func (cfg *apiConfig) handlerHashtagChirps(w http.ResponseWriter, r *http.Request) {
+
+	query, err := parseChirpQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query.Hashtag = r.PathValue("tag")
+
+	page, err := cfg.db.GetChirps(query)
+	if errors.Is(err, database.ErrorInvalidCursor) || errors.Is(err, database.ErrorInvalidHashtag) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve chirps")
+		return
+	}
+
+	chirps := chirpsFromDatabase(page.Chirps)
+	err = cfg.markLiked(r, chirpRefs(chirps))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve likes")
+		return
+	}
+
+	setNextLink(w, r, page.NextCursor)
+	respondWithJSON(w, http.StatusOK, chirps)
+}
+
+func (cfg *apiConfig) handlerHashtagsTrending(w http.ResponseWriter, r *http.Request) {
+
+	type trendingHashtag struct {
+		Tag   string `json:"tag"`
+		Count int    `json:"count"`
+	}
+
+	query := database.TrendingQuery{}
+
+	if window := r.URL.Query().Get("window"); window != "" {
+		duration, err := time.ParseDuration(window)
+		if err != nil || duration <= 0 || duration > database.MaxTrendingWindow {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("window must be a duration up to %s", database.MaxTrendingWindow))
+			return
+		}
+		query.Window = duration
+	}
+
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		limitInt, err := strconv.Atoi(limit)
+		if err != nil || limitInt < 1 || limitInt > database.MaxTrendingLimit {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", database.MaxTrendingLimit))
+			return
+		}
+		query.Limit = limitInt
+	}
+
+	dbTrending, err := cfg.db.TrendingHashtags(query)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve trending hashtags")
+		return
+	}
+
+	trending := []trendingHashtag{}
+	for _, hashtag := range dbTrending {
+		trending = append(trending, trendingHashtag{Tag: hashtag.Tag, Count: hashtag.Count})
+	}
+
+	respondWithJSON(w, http.StatusOK, trending)
+}
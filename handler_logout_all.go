@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+)
+
+// handlerLogoutAll signs the authenticated user out everywhere: every
+// session ends and every access token already issued stops validating,
+// including the one the request was made with.
+func (cfg *apiConfig) handlerLogoutAll(w http.ResponseWriter, r *http.Request) {
+
+	userId, ok := cfg.authenticatedUserId(w, r)
+	if !ok {
+		return
+	}
+
+	err := cfg.db.RevokeAllTokens(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign out")
+		return
+	}
+
+	logSecurityEvent(r, "logout_all", userId, 0)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,44 +1,67 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/rxmeez/chirpy/internal/auth"
+	"github.com/rxmeez/chirpy/internal/database"
 )
 
+// handlerRefreshToken trades a refresh token for a new access token and a
+// new refresh token. The old refresh token stops working; presenting it
+// again signs its session out everywhere.
 func (cfg *apiConfig) handlerRefreshToken(w http.ResponseWriter, r *http.Request) {
 
 	refreshToken, err := auth.GetBearerToken(r.Header)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find refresh token")
+		return
 	}
 
 	type response struct {
-		JWTToken string `json:"token"`
+		JWTToken     string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
-	userId, err := cfg.db.ValidateRefreshToken(refreshToken)
+	newRefreshToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create Refresh Token")
+		return
+	}
+
+	session, err := cfg.db.RotateRefreshToken(refreshToken, newRefreshToken)
+	if errors.Is(err, database.ErrorRefreshTokenReused) {
+		logSecurityEvent(r, "refresh_token_reuse", session.UserId, session.Id)
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrorRefreshTokenExpired) {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate refresh token")
 		return
 	}
 
-	// refreshToken, err = auth.MakeRefreshToken()
-	// if err != nil {
-	// 	respondWithError(w, http.StatusInternalServerError, "Couldn't create Refresh Token")
-	// 	return
-	// }
+	tokenVersion, err := cfg.db.TokenVersion(session.UserId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create JWT")
+		return
+	}
 
 	defaultExpiration := 60 * 60
 
-	token, err := auth.MakeJWT(userId, cfg.jwtSecret, time.Duration(defaultExpiration)*time.Second)
+	token, err := auth.MakeJWT(session.UserId, tokenVersion, cfg.jwtSecret, time.Duration(defaultExpiration)*time.Second)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create JWT")
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, response{
-		JWTToken: token,
+		JWTToken:     token,
+		RefreshToken: newRefreshToken,
 	})
 }
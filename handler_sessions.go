@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rxmeez/chirpy/internal/auth"
+	"github.com/rxmeez/chirpy/internal/database"
+)
+
+// Session is a signed-in device as shown to its user. The token hash stays
+// in the database.
+type Session struct {
+	Id         int       `json:"id"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func sessionFromDatabase(session database.Session) Session {
+	return Session{
+		Id:         session.Id,
+		Device:     session.Label,
+		UserAgent:  session.UserAgent,
+		CreatedAt:  session.CreatedAt,
+		LastUsedAt: session.LastUsedAt,
+		ExpiresAt:  session.ExpiresAt,
+	}
+}
+
+// authenticatedUserId returns the id of the user whose JWT the request
+// carries, responding with 401 if there isn't a valid one.
+func (cfg *apiConfig) authenticatedUserId(w http.ResponseWriter, r *http.Request) (int, bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT")
+		return 0, false
+	}
+
+	subject, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.db.TokenVersion)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT")
+		return 0, false
+	}
+
+	userId, err := strconv.Atoi(subject)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't parse user ID")
+		return 0, false
+	}
+	return userId, true
+}
+
+// handlerSessionsList lists the devices the authenticated user is signed
+// in on, oldest first.
+func (cfg *apiConfig) handlerSessionsList(w http.ResponseWriter, r *http.Request) {
+
+	userId, ok := cfg.authenticatedUserId(w, r)
+	if !ok {
+		return
+	}
+
+	dbSessions, err := cfg.db.GetSessions(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve sessions")
+		return
+	}
+
+	sessions := []Session{}
+	for _, dbSession := range dbSessions {
+		sessions = append(sessions, sessionFromDatabase(dbSession))
+	}
+
+	respondWithJSON(w, http.StatusOK, sessions)
+}
+
+// handlerSessionRevoke signs the authenticated user out of one device. Its
+// refresh token stops working; access tokens already issued run out on
+// their own.
+func (cfg *apiConfig) handlerSessionRevoke(w http.ResponseWriter, r *http.Request) {
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid session id")
+		return
+	}
+
+	userId, ok := cfg.authenticatedUserId(w, r)
+	if !ok {
+		return
+	}
+
+	err = cfg.db.RevokeSession(userId, id)
+	if errors.Is(err, database.ErrorSessionNotFound) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
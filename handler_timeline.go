@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/rxmeez/chirpy/internal/database"
+)
+
+// handlerTimeline lists the chirps of everyone the authenticated user
+// follows, newest first unless another sort is asked for.
+func (cfg *apiConfig) handlerTimeline(w http.ResponseWriter, r *http.Request) {
+
+	userId, ok := cfg.authenticatedUserId(w, r)
+	if !ok {
+		return
+	}
+
+	query, err := parseChirpQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.URL.Query().Get("sort") == "" {
+		query.Sort = database.SortDesc
+	}
+	query.TimelineOf = userId
+
+	page, err := cfg.db.GetChirps(query)
+	if errors.Is(err, database.ErrorInvalidCursor) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve timeline")
+		return
+	}
+
+	chirps := chirpsFromDatabase(page.Chirps)
+	err = cfg.markLiked(r, chirpRefs(chirps))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve likes")
+		return
+	}
+
+	setNextLink(w, r, page.NextCursor)
+	respondWithJSON(w, http.StatusOK, chirps)
+}
@@ -3,12 +3,29 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"time"
+
+	"github.com/rxmeez/chirpy/internal/database"
 )
 
 type User struct {
 	Id          int    `json:"id"`
 	Email       string `json:"email"`
 	IsChirpyRed bool   `json:"is_chirpy_red"`
+	// CreatedAt and UpdatedAt are null for users from before they were
+	// recorded.
+	CreatedAt *time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+func userFromDatabase(user database.User) User {
+	return User{
+		Id:          user.Id,
+		Email:       user.Email,
+		IsChirpyRed: user.IsChirpyRed,
+		CreatedAt:   user.CreatedAt,
+		UpdatedAt:   user.UpdatedAt,
+	}
 }
 
 func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request) {
@@ -31,10 +48,6 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, User{
-		Id:          user.Id,
-		Email:       user.Email,
-		IsChirpyRed: user.IsChirpyRed,
-	})
+	respondWithJSON(w, http.StatusCreated, userFromDatabase(user))
 
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/rxmeez/chirpy/internal/database"
+)
+
+// FollowUser is how users appear in follower listings. Emails stay private;
+// the handle is what other users mention them by.
+type FollowUser struct {
+	Id     int    `json:"id"`
+	Handle string `json:"handle"`
+}
+
+func (cfg *apiConfig) handlerUserFollow(w http.ResponseWriter, r *http.Request) {
+	cfg.handleFollowChange(w, r, cfg.db.Follow)
+}
+
+func (cfg *apiConfig) handlerUserUnfollow(w http.ResponseWriter, r *http.Request) {
+	cfg.handleFollowChange(w, r, cfg.db.Unfollow)
+}
+
+// handleFollowChange applies change to the authenticated user and the user in
+// the path.
+func (cfg *apiConfig) handleFollowChange(w http.ResponseWriter, r *http.Request, change func(followerId int, followeeId int) error) {
+
+	followeeId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user id")
+		return
+	}
+
+	followerId, ok := cfg.authenticatedUserId(w, r)
+	if !ok {
+		return
+	}
+
+	err = change(followerId, followeeId)
+	if errors.Is(err, database.ErrorCannotFollowSelf) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrorUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update follow")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerUserFollowers(w http.ResponseWriter, r *http.Request) {
+	cfg.handleFollowList(w, r, cfg.db.GetFollowers)
+}
+
+func (cfg *apiConfig) handlerUserFollowing(w http.ResponseWriter, r *http.Request) {
+	cfg.handleFollowList(w, r, cfg.db.GetFollowing)
+}
+
+// handleFollowList responds with one page of list for the user in the path.
+func (cfg *apiConfig) handleFollowList(w http.ResponseWriter, r *http.Request, list func(database.FollowQuery) (database.UserPage, error)) {
+
+	userId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user id")
+		return
+	}
+
+	query := database.FollowQuery{
+		UserId: userId,
+		Cursor: r.URL.Query().Get("cursor"),
+	}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > database.MaxUserLimit {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", database.MaxUserLimit))
+			return
+		}
+	}
+
+	page, err := list(query)
+	if errors.Is(err, database.ErrorUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if errors.Is(err, database.ErrorInvalidCursor) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve users")
+		return
+	}
+
+	users := []FollowUser{}
+	for _, user := range page.Users {
+		users = append(users, FollowUser{Id: user.Id, Handle: database.UserHandle(user.Email)})
+	}
+
+	setNextLink(w, r, page.NextCursor)
+	respondWithJSON(w, http.StatusOK, users)
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/rxmeez/chirpy/internal/auth"
+	"github.com/rxmeez/chirpy/internal/database"
 )
 
 func (cfg *apiConfig) handlerUsersLogin(w http.ResponseWriter, r *http.Request) {
@@ -14,12 +15,15 @@ func (cfg *apiConfig) handlerUsersLogin(w http.ResponseWriter, r *http.Request)
 		Email            string `json:"email"`
 		Password         string `json:"password"`
 		ExpiresInSeconds int    `json:"expires_in_seconds"`
+		// Device labels the session this login starts, e.g. "work laptop".
+		Device string `json:"device"`
 	}
 
 	type response struct {
 		User
 		Token        string `json:"token"`
 		RefreshToken string `json:"refresh_token"`
+		SessionId    int    `json:"session_id"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -42,7 +46,7 @@ func (cfg *apiConfig) handlerUsersLogin(w http.ResponseWriter, r *http.Request)
 		params.ExpiresInSeconds = defaultExpiration
 	}
 
-	token, err := auth.MakeJWT(user.Id, cfg.jwtSecret, time.Duration(params.ExpiresInSeconds)*time.Second)
+	token, err := auth.MakeJWT(user.Id, user.TokenVersion, cfg.jwtSecret, time.Duration(params.ExpiresInSeconds)*time.Second)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create JWT")
 		return
@@ -54,20 +58,20 @@ func (cfg *apiConfig) handlerUsersLogin(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = cfg.db.StoreRefreshToken(user.Id, refreshTokenString, 60*24*time.Hour)
+	session, err := cfg.db.StoreRefreshToken(user.Id, refreshTokenString, 60*24*time.Hour, database.Device{
+		Label:     params.Device,
+		UserAgent: r.UserAgent(),
+	})
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't store refresh token")
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, response{
-		User: User{
-			Id:          user.Id,
-			Email:       user.Email,
-			IsChirpyRed: user.IsChirpyRed,
-		},
+		User:         userFromDatabase(user),
 		Token:        token,
 		RefreshToken: refreshTokenString,
+		SessionId:    session.Id,
 	})
 
 }
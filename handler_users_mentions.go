@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/rxmeez/chirpy/internal/database"
+)
+
+func (cfg *apiConfig) handlerUserMentions(w http.ResponseWriter, r *http.Request) {
+
+	userId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user id")
+		return
+	}
+
+	_, err = cfg.db.GetUser(userId)
+	if errors.Is(err, database.ErrorUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve user")
+		return
+	}
+
+	query, err := parseChirpQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query.MentionId = userId
+
+	page, err := cfg.db.GetChirps(query)
+	if errors.Is(err, database.ErrorInvalidCursor) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve chirps")
+		return
+	}
+
+	chirps := chirpsFromDatabase(page.Chirps)
+	err = cfg.markLiked(r, chirpRefs(chirps))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve likes")
+		return
+	}
+
+	setNextLink(w, r, page.NextCursor)
+	respondWithJSON(w, http.StatusOK, chirps)
+}
@@ -21,7 +21,7 @@ func (cfg *apiConfig) handlerUsersUpdate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	subject, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	subject, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.db.TokenVersion)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT")
 		return
@@ -46,10 +46,6 @@ func (cfg *apiConfig) handlerUsersUpdate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, User{
-		Id:          user.Id,
-		Email:       user.Email,
-		IsChirpyRed: user.IsChirpyRed,
-	})
+	respondWithJSON(w, http.StatusOK, userFromDatabase(user))
 
 }
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,23 +14,42 @@ import (
 )
 
 var ErrNoAuthHeaderIncluded = errors.New("not auth header included in request")
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// claims are the claims of a chirpy access token. TokenVersion is the
+// user's token version when it was issued; bumping the version revokes
+// every token issued before.
+type claims struct {
+	jwt.RegisteredClaims
+	TokenVersion int `json:"token_version"`
+}
+
+// TokenVersionFunc returns the token version userId's access tokens must
+// carry.
+type TokenVersionFunc func(userId int) (int, error)
 
-func MakeJWT(userId int, tokenSecret string, expiresIn time.Duration) (string, error) {
+func MakeJWT(userId int, tokenVersion int, tokenSecret string, expiresIn time.Duration) (string, error) {
 
 	signingKey := []byte(tokenSecret)
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
-		Subject:   fmt.Sprintf("%d", userId),
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "chirpy",
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+			Subject:   fmt.Sprintf("%d", userId),
+		},
+		TokenVersion: tokenVersion,
 	})
 
 	return token.SignedString(signingKey)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (string, error) {
-	claimsStruct := jwt.RegisteredClaims{}
+// ValidateJWT returns the user id an access token was issued to. A token
+// that doesn't carry the version tokenVersion reports for its user gives
+// ErrTokenRevoked.
+func ValidateJWT(tokenString, tokenSecret string, tokenVersion TokenVersionFunc) (string, error) {
+	claimsStruct := claims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
@@ -53,6 +73,18 @@ func ValidateJWT(tokenString, tokenSecret string) (string, error) {
 		return "", errors.New("Invalid Issuer")
 	}
 
+	userId, err := strconv.Atoi(userIdString)
+	if err != nil {
+		return "", err
+	}
+	version, err := tokenVersion(userId)
+	if err != nil {
+		return "", err
+	}
+	if claimsStruct.TokenVersion != version {
+		return "", ErrTokenRevoked
+	}
+
 	return userIdString, nil
 }
 
@@ -0,0 +1,45 @@
+// Package chirptext puts chirp bodies into the one form they are stored and
+// measured in.
+package chirptext
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/rivo/uniseg"
+	"golang.org/x/text/unicode/norm"
+)
+
+// invisible are characters that take no space. They are stripped so they
+// can't pad a chirp or split a word past the moderation rules. The zero
+// width joiner and non-joiner are kept: emoji sequences and several scripts
+// need them.
+var invisible = map[rune]bool{
+	'\u00AD': true, // soft hyphen
+	'\u180E': true, // Mongolian vowel separator
+	'\u200B': true, // zero width space
+	'\u2060': true, // word joiner
+	'\uFEFF': true, // zero width no-break space
+}
+
+// Normalize strips control characters other than newlines and tabs, strips
+// zero-width characters, and puts what is left in NFC, so text that looks
+// the same is stored the same.
+func Normalize(body string) string {
+	stripped := strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) || invisible[r] {
+			return -1
+		}
+		return r
+	}, body)
+	return norm.NFC.String(stripped)
+}
+
+// Length counts the user-perceived characters (grapheme clusters) of body,
+// so an emoji made of several code points counts once.
+func Length(body string) int {
+	return uniseg.GraphemeClusterCount(body)
+}
@@ -0,0 +1,46 @@
+package chirptext
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	cases := []struct {
+		body string
+		want string
+	}{
+		{"plain", "plain"},
+		{"line one\nline\ttwo", "line one\nline\ttwo"},
+		{"bell\a and\x00 nul\u0085", "bell and nul"},
+		{"ker\u200Bfuf\u00ADfle\uFEFF", "kerfuffle"},
+		{"cafe\u0301", "caf\u00E9"},
+		{"\U0001F468\u200D\U0001F469\u200D\U0001F467", "\U0001F468\u200D\U0001F469\u200D\U0001F467"},
+	}
+	for _, c := range cases {
+		if got := Normalize(c.body); got != c.want {
+			t.Errorf("Normalize(%q) = %q, want %q", c.body, got, c.want)
+		}
+	}
+}
+
+func TestLength(t *testing.T) {
+	cases := []struct {
+		body string
+		want int
+	}{
+		{"", 0},
+		{"hello", 5},
+		{"caf\u00E9", 4},
+		{"cafe\u0301", 4},
+		{strings.Repeat("\U0001F600", 50), 50},
+		{"\U0001F468\u200D\U0001F469\u200D\U0001F467", 1},
+		{"\U0001F1EB\U0001F1F7", 1},
+		{"\U0001F44D\U0001F3FD!", 2},
+	}
+	for _, c := range cases {
+		if got := Length(c.body); got != c.want {
+			t.Errorf("Length(%q) = %d, want %d", c.body, got, c.want)
+		}
+	}
+}
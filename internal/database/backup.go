@@ -0,0 +1,182 @@
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupTimeFormat sorts lexically in chronological order, which is what
+// rotateBackups relies on.
+const backupTimeFormat = "20060102T150405.000Z"
+
+// backupPath names a snapshot of the store at dbPath taken at now, e.g.
+// backups/database-20240102T030405.678Z.json.
+func backupPath(dbPath string, dir string, now time.Time) string {
+	ext := filepath.Ext(dbPath)
+	base := strings.TrimSuffix(filepath.Base(dbPath), ext)
+	return filepath.Join(dir, base+"-"+now.UTC().Format(backupTimeFormat)+ext)
+}
+
+// rotateBackups deletes all but the newest keep snapshots of dbPath in dir.
+// A keep of zero or less keeps everything.
+func rotateBackups(dbPath string, dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	ext := filepath.Ext(dbPath)
+	prefix := strings.TrimSuffix(filepath.Base(dbPath), ext) + "-"
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	backups := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ext) {
+			backups = append(backups, name)
+		}
+	}
+	sort.Strings(backups)
+
+	for len(backups) > keep {
+		err := os.Remove(filepath.Join(dir, backups[0]))
+		if err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Backup writes a consistent snapshot of everything acknowledged so far to a
+// timestamped file in dir and rotates out all but the newest keep snapshots.
+func (db *DB) Backup(dir string, keep int) (string, error) {
+	db.mux.RLock()
+	data, err := json.Marshal(db.data)
+	db.mux.RUnlock()
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	path := backupPath(db.path, dir, time.Now())
+	err = writeFileAtomic(path, data, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	return path, rotateBackups(db.path, dir, keep)
+}
+
+// Backup uses VACUUM INTO, which copies a single transaction's view of the
+// database without blocking writers.
+func (db *SQLiteDB) Backup(dir string, keep int) (string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	path := backupPath(db.path, dir, time.Now())
+	_, err = db.conn.Exec("VACUUM INTO ?", path)
+	if err != nil {
+		return "", err
+	}
+
+	return path, rotateBackups(db.path, dir, keep)
+}
+
+// Restore validates the snapshot at src and replaces the store at dst with
+// it. The server must not be running against dst.
+func Restore(driver string, src string, dst string) error {
+	switch driver {
+	case "", "json":
+		return restoreJSON(src, dst)
+	case "sqlite":
+		return restoreSQLite(src, dst)
+	}
+	return fmt.Errorf("unknown database driver %q", driver)
+}
+
+func restoreJSON(src string, dst string) error {
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	content, _, err = migrateDocument(content)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrorCorruptFile, src, err)
+	}
+
+	dbStructure := DBStructure{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&dbStructure)
+	if err == nil {
+		err = dbStructure.validate()
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrorCorruptFile, src, err)
+	}
+
+	err = writeFileAtomic(dst, content, 0644)
+	if err != nil {
+		return err
+	}
+
+	// A log left by the old database would otherwise be replayed on top of
+	// the snapshot.
+	err = os.Remove(dst + ".wal")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func restoreSQLite(src string, dst string) error {
+	conn, err := sql.Open("sqlite", src+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	_, err = (&SQLiteDB{path: src, conn: conn}).schemaVersion()
+	if err == nil {
+		var result string
+		err = conn.QueryRow("PRAGMA integrity_check").Scan(&result)
+		if err == nil && result != "ok" {
+			err = fmt.Errorf("%w: %s: %s", ErrorCorruptFile, src, result)
+		}
+	}
+	conn.Close()
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	for _, suffix := range []string{"-wal", "-shm"} {
+		err := os.Remove(dst + suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return writeFileAtomic(dst, data, 0644)
+}
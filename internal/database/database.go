@@ -1,169 +1,602 @@
 package database
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"maps"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
 var ErrorEmptyFile = errors.New("EmptyFile")
 var ErrorChirpDoesNotExist = errors.New("Chirp id doesn't exist")
+var ErrorNotChirpAuthor = errors.New("Forbidden to change another authors chirp")
+var ErrorCorruptFile = errors.New("Database file is corrupt")
+
+// now is the package clock: creation, edit and hashtag times, session
+// expiry and every other time both stores record or compare against come
+// from it. Tests replace it to pin time.
+var now = time.Now
+
+// Mode controls what NewDB does with an existing database file.
+type Mode int
+
+const (
+	// ModePersistent keeps an existing database file and only creates a
+	// new one when nothing exists at the path.
+	ModePersistent Mode = iota
+	// ModeDev wipes the database file on every start.
+	ModeDev
+)
+
+// ParseMode maps the DB_MODE setting onto a Mode. An empty string selects
+// ModePersistent.
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "", "persistent":
+		return ModePersistent, nil
+	case "dev":
+		return ModeDev, nil
+	}
+	return ModePersistent, fmt.Errorf("unknown database mode %q", s)
+}
 
+// DB is a Store that keeps everything in one JSON file. The file is read
+// once by NewDB; after that data is the source of truth and every write is
+// persisted according to opts.Durability. Methods that only read take mux
+// for reading, methods that modify data hold it for writing.
 type DB struct {
 	path string
 	mux  *sync.RWMutex
+	opts Options
+
+	data DBStructure
+	indexes
+
+	// logEntries counts writes appended to the log since the last
+	// compaction.
+	logEntries int
+	// dirty is set while a debounced flush is pending.
+	dirty      bool
+	flushTimer *time.Timer
 }
 
 type DBStructure struct {
-	Chirps map[int]Chirp `json:"chirps"`
-	Users  map[int]User  `json:"users"`
+	SchemaVersion int           `json:"schema_version"`
+	Chirps        map[int]Chirp `json:"chirps"`
+	Users         map[int]User  `json:"users"`
+	Sequences     Sequences     `json:"sequences"`
+	// Tombstones maps deleted chirps that still had replies to the chirp
+	// they replied to, or 0, so threads stay connected. See ThreadNode.
+	Tombstones map[int]int `json:"tombstones,omitempty"`
+	// Follows maps each user to the ids of the users they follow, in
+	// ascending order.
+	Follows map[int][]int `json:"follows,omitempty"`
+	// Likes maps each chirp to the ids of the users who like it, in
+	// ascending order.
+	Likes map[int][]int `json:"likes,omitempty"`
+	// Revisions maps each edited chirp to its earlier bodies, oldest
+	// first.
+	Revisions map[int][]Revision `json:"revisions,omitempty"`
+	// Flags maps chirps held for review to the moderation rules they
+	// matched.
+	Flags map[int]Flag `json:"flags,omitempty"`
+	// Sessions holds every signed-in device by session id.
+	Sessions map[int]Session `json:"sessions,omitempty"`
+	// TokenKey is the fingerprint of the key session token hashes are
+	// keyed under; empty while they are plain SHA-256.
+	TokenKey string `json:"token_key,omitempty"`
+}
+
+// clone returns a copy of d that apply can change without changing d. Only
+// the maps are copied; apply never modifies the records and slices they
+// share.
+func (d DBStructure) clone() DBStructure {
+	d.Chirps = maps.Clone(d.Chirps)
+	d.Users = maps.Clone(d.Users)
+	d.Tombstones = maps.Clone(d.Tombstones)
+	d.Follows = maps.Clone(d.Follows)
+	d.Likes = maps.Clone(d.Likes)
+	d.Revisions = maps.Clone(d.Revisions)
+	d.Flags = maps.Clone(d.Flags)
+	d.Sessions = maps.Clone(d.Sessions)
+	return d
+}
+
+// Sequences holds the last id handed out per collection. Ids only ever go
+// up, so a deleted record's id is never given to a new one.
+type Sequences struct {
+	Chirps   int `json:"chirps"`
+	Users    int `json:"users"`
+	Sessions int `json:"sessions,omitempty"`
 }
 
 type Chirp struct {
-	Id       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorId int    `json:"author_id"`
+	Id       int       `json:"id"`
+	Body     string    `json:"body"`
+	AuthorId int       `json:"author_id"`
+	Hashtags []Hashtag `json:"hashtags,omitempty"`
+	// Mentions holds the ids of the users the body mentions, resolved when
+	// the chirp was written.
+	Mentions []int `json:"mentions,omitempty"`
+	// InReplyTo is the id of the chirp this one replies to, or 0. It is kept
+	// when that chirp is deleted.
+	InReplyTo int `json:"in_reply_to,omitempty"`
+	// RechirpOf is the id of the chirp this one shares unchanged, or 0. A
+	// rechirp has no body and is deleted along with its original.
+	RechirpOf int `json:"rechirp_of,omitempty"`
+	// QuoteOf is the id of the chirp this one quotes, or 0. Unlike a
+	// rechirp, a quote outlives the chirp it quotes and keeps its id.
+	QuoteOf int `json:"quote_of,omitempty"`
+	// CreatedAt never goes backwards from one chirp to the next, so id order
+	// is creation order. It and UpdatedAt are nil for chirps created before
+	// they were recorded.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+
+	// LikeCount is filled in when a chirp is read. The likes themselves are
+	// stored apart from the chirp, so it is never written out.
+	LikeCount int `json:"-"`
+	// Shared is the chirp SharedId points at, filled in when a chirp is
+	// read. It is nil once a quoted chirp has been deleted, and its own
+	// Shared is never filled in.
+	Shared *Chirp `json:"-"`
 }
 
-func NewDB(path string) (*DB, error) {
-	if _, err := os.Stat(path); err == nil {
-		err := os.Remove(path)
+func NewDB(path string, opts Options) (*DB, error) {
+	db := &DB{
+		path: path,
+		mux:  &sync.RWMutex{},
+		opts: opts,
+	}
+
+	if opts.Mode == ModeDev {
+		for _, p := range []string{path, db.logPath()} {
+			if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+	}
+
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		file, err := os.Create(path)
 		if err != nil {
-			log.Fatal(err)
 			return nil, err
 		}
+		file.Close()
+	} else if err != nil {
+		return nil, err
 	}
-	file, err := os.Create(path)
-	defer file.Close()
-	if err != nil {
-		log.Fatal(err)
+
+	dbStructure, err := db.loadDB()
+	if err != nil && !errors.Is(err, ErrorEmptyFile) {
 		return nil, err
 	}
 
-	return &DB{
-		path: path,
-		mux:  &sync.RWMutex{},
-	}, nil
+	if err == nil {
+		rekey, err := checkTokenKey(dbStructure.TokenKey, opts.TokenKey)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, path)
+		}
+		if rekey {
+			err = dbStructure.keyTokenHashes(opts.TokenKey)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", ErrorCorruptFile, path, err)
+			}
+		}
+	}
+
+	// Rewrite the snapshot once at startup. This persists anything loadDB
+	// migrated or rekeyed and folds whatever the previous run left in the log into the
+	// snapshot, dropping a torn final entry so later appends start on a
+	// clean line.
+	if err == nil {
+		err = db.compact(dbStructure)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Nothing was ever acknowledged; at most the log holds a torn entry.
+		err = os.Remove(db.logPath())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		dbStructure = DBStructure{
+			SchemaVersion: currentSchemaVersion,
+			Chirps:        make(map[int]Chirp),
+			Users:         make(map[int]User),
+			Tombstones:    make(map[int]int),
+			Follows:       make(map[int][]int),
+			Likes:         make(map[int][]int),
+			Revisions:     make(map[int][]Revision),
+			Flags:         make(map[int]Flag),
+			Sessions:      make(map[int]Session),
+		}
+		if len(opts.TokenKey) > 0 {
+			dbStructure.TokenKey = tokenKeyFingerprint(opts.TokenKey)
+		}
+	}
+
+	db.data = dbStructure
+	db.buildIndexes()
+
+	return db, nil
 
 }
 
+// Close writes out a pending debounced flush.
+func (db *DB) Close() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if db.flushTimer != nil {
+		db.flushTimer.Stop()
+		db.flushTimer = nil
+	}
+	if db.dirty {
+		err := db.writeDB(db.data)
+		if err != nil {
+			return err
+		}
+		db.dirty = false
+	}
+	return nil
+}
+
 func (db *DB) loadDB() (DBStructure, error) {
 	content, err := os.ReadFile(db.path)
-	if len(content) == 0 {
-		return DBStructure{}, ErrorEmptyFile
+	if err != nil {
+		return DBStructure{}, err
 	}
+
+	entries, err := db.readLog()
 	if err != nil {
-		log.Fatal(err)
 		return DBStructure{}, err
 	}
 
-	chirps := DBStructure{}
+	if len(content) == 0 && len(entries) == 0 {
+		return DBStructure{}, ErrorEmptyFile
+	}
+
+	dbStructure := DBStructure{SchemaVersion: currentSchemaVersion}
+
+	if len(content) > 0 {
+		content, _, err = migrateDocument(content)
+		if err != nil {
+			return DBStructure{}, fmt.Errorf("%w: %s: %v", ErrorCorruptFile, db.path, err)
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&dbStructure)
+		if err != nil {
+			return DBStructure{}, fmt.Errorf("%w: %s: %v", ErrorCorruptFile, db.path, err)
+		}
+	}
+
+	if dbStructure.Chirps == nil {
+		dbStructure.Chirps = make(map[int]Chirp)
+	}
+	if dbStructure.Users == nil {
+		dbStructure.Users = make(map[int]User)
+	}
+	if dbStructure.Tombstones == nil {
+		dbStructure.Tombstones = make(map[int]int)
+	}
+	if dbStructure.Follows == nil {
+		dbStructure.Follows = make(map[int][]int)
+	}
+	if dbStructure.Likes == nil {
+		dbStructure.Likes = make(map[int][]int)
+	}
+	if dbStructure.Revisions == nil {
+		dbStructure.Revisions = make(map[int][]Revision)
+	}
+	if dbStructure.Flags == nil {
+		dbStructure.Flags = make(map[int]Flag)
+	}
+	if dbStructure.Sessions == nil {
+		dbStructure.Sessions = make(map[int]Session)
+	}
+
+	for i, entry := range entries {
+		err = entry.apply(&dbStructure)
+		if err != nil {
+			return DBStructure{}, fmt.Errorf("%w: %s entry %d: %v", ErrorCorruptFile, db.logPath(), i+1, err)
+		}
+	}
 
-	err = json.Unmarshal(content, &chirps)
+	err = dbStructure.validate()
 	if err != nil {
-		log.Fatal(err)
-		return DBStructure{}, err
+		return DBStructure{}, fmt.Errorf("%w: %s: %v", ErrorCorruptFile, db.path, err)
+	}
+
+	return dbStructure, nil
+
+}
+
+// validate checks the invariants the rest of the package relies on: every
+// record is stored under its own id, below its sequence, and no two users
+// share an email.
+func (d *DBStructure) validate() error {
+	if d.SchemaVersion != currentSchemaVersion {
+		return fmt.Errorf("schema version %d, want %d", d.SchemaVersion, currentSchemaVersion)
+	}
+
+	for id, chirp := range d.Chirps {
+		if chirp.Id != id {
+			return fmt.Errorf("chirp %d stored under key %d", chirp.Id, id)
+		}
+		if id > d.Sequences.Chirps {
+			return fmt.Errorf("chirp %d is above the chirp sequence %d", id, d.Sequences.Chirps)
+		}
 	}
 
-	return chirps, nil
+	for id, chirp := range d.Chirps {
+		if chirp.RechirpOf == 0 {
+			continue
+		}
+		original, ok := d.Chirps[chirp.RechirpOf]
+		if !ok {
+			return fmt.Errorf("chirp %d rechirps missing chirp %d", id, chirp.RechirpOf)
+		}
+		if original.RechirpOf != 0 {
+			return fmt.Errorf("chirp %d rechirps rechirp %d", id, original.Id)
+		}
+	}
+
+	for id := range d.Revisions {
+		if _, ok := d.Chirps[id]; !ok {
+			return fmt.Errorf("revisions of missing chirp %d", id)
+		}
+	}
+
+	for id, flag := range d.Flags {
+		if _, ok := d.Chirps[id]; !ok {
+			return fmt.Errorf("flag of missing chirp %d", id)
+		}
+		if flag.ChirpId != id || len(flag.Rules) == 0 {
+			return fmt.Errorf("flag of chirp %d is malformed", id)
+		}
+	}
 
+	for id := range d.Tombstones {
+		if _, ok := d.Chirps[id]; ok {
+			return fmt.Errorf("chirp %d is both live and a tombstone", id)
+		}
+		if id > d.Sequences.Chirps {
+			return fmt.Errorf("tombstone %d is above the chirp sequence %d", id, d.Sequences.Chirps)
+		}
+	}
+
+	emails := make(map[string]int, len(d.Users))
+	for id, user := range d.Users {
+		if user.Id != id {
+			return fmt.Errorf("user %d stored under key %d", user.Id, id)
+		}
+		if id > d.Sequences.Users {
+			return fmt.Errorf("user %d is above the user sequence %d", id, d.Sequences.Users)
+		}
+		if other, ok := emails[user.Email]; ok {
+			return fmt.Errorf("users %d and %d share email %q", other, id, user.Email)
+		}
+		emails[user.Email] = id
+	}
+
+	for followerId, followeeIds := range d.Follows {
+		if _, ok := d.Users[followerId]; !ok {
+			return fmt.Errorf("follows of missing user %d", followerId)
+		}
+		for i, followeeId := range followeeIds {
+			if _, ok := d.Users[followeeId]; !ok {
+				return fmt.Errorf("user %d follows missing user %d", followerId, followeeId)
+			}
+			if followeeId == followerId {
+				return fmt.Errorf("user %d follows themselves", followerId)
+			}
+			if i > 0 && followeeIds[i-1] >= followeeId {
+				return fmt.Errorf("follows of user %d are not sorted", followerId)
+			}
+		}
+	}
+
+	hashes := make(map[string]int, len(d.Sessions))
+	for id, session := range d.Sessions {
+		if session.Id != id {
+			return fmt.Errorf("session %d stored under key %d", session.Id, id)
+		}
+		if id > d.Sequences.Sessions {
+			return fmt.Errorf("session %d is above the session sequence %d", id, d.Sequences.Sessions)
+		}
+		if _, ok := d.Users[session.UserId]; !ok {
+			return fmt.Errorf("session %d of missing user %d", id, session.UserId)
+		}
+		for _, hash := range append([]string{session.TokenHash}, session.Rotated...) {
+			if other, ok := hashes[hash]; ok {
+				return fmt.Errorf("sessions %d and %d share a token", other, id)
+			}
+			hashes[hash] = id
+		}
+	}
+
+	for chirpId, userIds := range d.Likes {
+		if _, ok := d.Chirps[chirpId]; !ok {
+			return fmt.Errorf("likes of missing chirp %d", chirpId)
+		}
+		for i, userId := range userIds {
+			if _, ok := d.Users[userId]; !ok {
+				return fmt.Errorf("chirp %d is liked by missing user %d", chirpId, userId)
+			}
+			if i > 0 && userIds[i-1] >= userId {
+				return fmt.Errorf("likes of chirp %d are not sorted", chirpId)
+			}
+		}
+	}
+
+	return nil
 }
 
 func (db *DB) writeDB(dbStructure DBStructure) error {
 	data, err := json.Marshal(dbStructure)
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
-	err = os.WriteFile(db.path, data, 0644)
+	return writeFileAtomic(db.path, data, 0644)
+}
+
+// writeFileAtomic replaces path with data so that a crash leaves either the
+// old or the new contents on disk, never a mix of both.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
-	return nil
-}
+	defer os.Remove(tmp.Name())
 
-func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
 
-	dbStructure, err := db.loadDB()
-	if err != nil && !errors.Is(err, ErrorEmptyFile) {
-		log.Fatal(err)
-		return Chirp{}, err
+	err = os.Chmod(tmp.Name(), perm)
+	if err != nil {
+		return err
 	}
 
-	if errors.Is(err, ErrorEmptyFile) {
-		dbStructure = DBStructure{
-			Chirps: make(map[int]Chirp),
-		}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir makes a rename or remove inside dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
 	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
 
-	chirpId := len(dbStructure.Chirps) + 1
+	db.mux.Lock()
+	defer db.mux.Unlock()
 
-	chirp := Chirp{Id: chirpId, Body: body, AuthorId: authorId}
+	return db.createChirp(Chirp{Body: body, AuthorId: authorId})
+}
+
+// createChirp assigns chirp an id, fills in what is derived from its body and
+// saves it. The caller must hold mux for writing.
+func (db *DB) createChirp(chirp Chirp) (Chirp, error) {
+	createdAt := now().UTC()
+	if n := len(db.chirpIds); n > 0 {
+		if latest := db.data.Chirps[db.chirpIds[n-1]].CreatedAt; latest != nil && latest.After(createdAt) {
+			createdAt = *latest
+		}
+	}
 
-	dbStructure.Chirps[chirpId] = chirp
+	chirp.Id = db.data.Sequences.Chirps + 1
+	chirp.CreatedAt = &createdAt
+	chirp.UpdatedAt = &createdAt
+	chirp.Hashtags = newHashtags(chirp.Body, createdAt)
+	chirp.Mentions = resolveMentions(ExtractMentions(chirp.Body), func(handle string) []int {
+		return db.usersByHandle[handle]
+	})
 
-	err = db.writeDB(dbStructure)
+	err := db.save(walEntry{Op: opPutChirp, Chirp: &chirp})
 	if err != nil {
-		log.Fatal(err)
 		return Chirp{}, err
 	}
 
 	return chirp, nil
 }
 
-func (db *DB) GetChirps() ([]Chirp, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil && !errors.Is(err, ErrorEmptyFile) {
-		return []Chirp{}, err
+// view returns chirp as reads see it, with its like count and the chirp it
+// shares filled in. The caller must hold mux.
+func (db *DB) view(chirp Chirp) Chirp {
+	chirp.LikeCount = len(db.data.Likes[chirp.Id])
+	if shared, ok := db.data.Chirps[chirp.SharedId()]; ok {
+		shared.LikeCount = len(db.data.Likes[shared.Id])
+		chirp.Shared = &shared
 	}
+	return chirp
+}
 
-	chirps := make([]Chirp, 0, len(dbStructure.Chirps))
+// GetChirps returns the page of chirps q asks for, walking the id indexes
+// rather than the whole chirp map.
+func (db *DB) GetChirps(q ChirpQuery) (ChirpPage, error) {
+	q, c, err := q.normalize()
+	if err != nil {
+		return ChirpPage{}, err
+	}
 
-	for _, v := range dbStructure.Chirps {
-		chirps = append(chirps, v)
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	var ids []int
+	var next string
+	if q.Sort == SortLikes {
+		likes := func(id int) int { return len(db.data.Likes[id]) }
+		ids, next = pageByLikes(db.chirpSourcesFor(q), likes, q.Limit, c)
+	} else {
+		ids, next = pageIds(db.chirpSourcesFor(q), q.Limit, c)
+	}
+	chirps := make([]Chirp, 0, len(ids))
+	for _, id := range ids {
+		chirps = append(chirps, db.view(db.data.Chirps[id]))
 	}
 
-	return chirps, nil
+	return ChirpPage{Chirps: chirps, NextCursor: next}, nil
 }
 
 func (db *DB) GetChirp(id int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil && !errors.Is(err, ErrorEmptyFile) {
-		return Chirp{}, err
-	}
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 
-	chirp, ok := dbStructure.Chirps[id]
+	chirp, ok := db.data.Chirps[id]
 	if !ok {
 		return chirp, ErrorChirpDoesNotExist
 	}
 
-	return chirp, nil
+	return db.view(chirp), nil
 }
 
 func (db *DB) DeleteChirp(id, authorId int) error {
 
-	dbStructure, err := db.loadDB()
-	if err != nil && !errors.Is(err, ErrorEmptyFile) {
-		return err
-	}
+	db.mux.Lock()
+	defer db.mux.Unlock()
 
-	chirp, ok := dbStructure.Chirps[id]
+	chirp, ok := db.data.Chirps[id]
 	if !ok {
 		return ErrorChirpDoesNotExist
 	}
 
 	if chirp.AuthorId != authorId {
-		return errors.New("Forbidden to delete another authors chirp")
+		return ErrorNotChirpAuthor
 	}
 
-	delete(dbStructure.Chirps, id)
-
-	err = db.writeDB(dbStructure)
+	// Replies are kept, so a chirp that has any leaves a tombstone behind.
+	// Rechirps go with it.
+	tombstone := len(db.chirpsByParent[id]) > 0
+	rechirps := append([]int(nil), db.rechirpsOf[id]...)
+	err := db.save(walEntry{Op: opDeleteChirp, Id: id, Tombstone: tombstone, Rechirps: rechirps})
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
 
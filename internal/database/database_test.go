@@ -1,13 +1,20 @@
 package database
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewDB(t *testing.T) {
 	path := "./database.test.json"
-	db, err := NewDB(path)
+	db, err := NewDB(path, Options{Mode: ModeDev})
 	defer os.Remove(path)
 	if err != nil {
 		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
@@ -25,9 +32,68 @@ func TestNewDB(t *testing.T) {
 		t.Errorf("DB mutex is nil")
 	}
 }
+func TestNewDBPersistentKeepsData(t *testing.T) {
+	path := "./database.test.json"
+	db, err := NewDB(path, Options{Mode: ModeDev})
+	defer os.Remove(path)
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+
+	if _, err := db.CreateChirp("test chirp", 1); err != nil {
+		t.Fatalf("CreateChirp resulted in an error: %v", err)
+	}
+
+	db, err = NewDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+
+	chirps, err := allChirps(db)
+	if err != nil {
+		t.Fatalf("GetChirps resulted in an error: %v", err)
+	}
+	if len(chirps) != 1 {
+		t.Errorf("Expected 1 chirp after reopening, got %d", len(chirps))
+	}
+
+	db, err = NewDB(path, Options{Mode: ModeDev})
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+
+	chirps, err = allChirps(db)
+	if err != nil {
+		t.Fatalf("GetChirps resulted in an error: %v", err)
+	}
+	if len(chirps) != 0 {
+		t.Errorf("Expected dev mode to wipe chirps, got %d", len(chirps))
+	}
+}
+
+func TestNewDBCorruptFile(t *testing.T) {
+	path := "./database.test.json"
+	defer os.Remove(path)
+
+	cases := map[string]string{
+		"truncated":     `{"chirps": {"1": {"id": 1, "bo`,
+		"unknown field": `{"chirps": {}, "posts": {}}`,
+		"mismatched id": `{"chirps": {"1": {"id": 2, "body": "test chirp"}}}`,
+	}
+
+	for name, data := range cases {
+		os.WriteFile(path, []byte(data), 0644)
+
+		_, err := NewDB(path, Options{Mode: ModePersistent})
+		if !errors.Is(err, ErrorCorruptFile) {
+			t.Errorf("%s: expected ErrorCorruptFile, got %v", name, err)
+		}
+	}
+}
+
 func TestLoadDB(t *testing.T) {
 	path := "./database.test.json"
-	db, _ := NewDB(path)
+	db, _ := NewDB(path, Options{Mode: ModeDev})
 	defer os.Remove(path)
 
 	data := `{"chirps": {"1": {"id": 1, "body": "test chirp"}}}`
@@ -54,7 +120,7 @@ func TestLoadDB(t *testing.T) {
 
 func TestWriteDB(t *testing.T) {
 	path := "./database.test.json"
-	db, _ := NewDB(path)
+	db, _ := NewDB(path, Options{Mode: ModeDev})
 	defer os.Remove(path)
 
 	dbStructure := DBStructure{
@@ -76,7 +142,7 @@ func TestWriteDB(t *testing.T) {
 		t.Fatalf("Could not read file: %v", err)
 	}
 
-	expectedData := `{"chirps":{"1":{"id":1,"body":"test chirp"}}}`
+	expectedData := `{"schema_version":0,"chirps":{"1":{"id":1,"body":"test chirp","author_id":0}},"users":null,"sequences":{"chirps":0,"users":0}}`
 	if string(data) != expectedData {
 		t.Errorf("Expected data to be '%s', got '%s'", expectedData, string(data))
 	}
@@ -84,8 +150,10 @@ func TestWriteDB(t *testing.T) {
 
 func TestCreateChirp(t *testing.T) {
 	path := "./database.test.json"
-	db, _ := NewDB(path)
+	db, _ := NewDB(path, Options{Mode: ModeDev})
 	defer os.Remove(path)
+	defer func() { now = time.Now }()
+	now = func() time.Time { return hashtagTestTime }
 
 	// Create a chirp
 	body := "test chirp"
@@ -103,15 +171,256 @@ func TestCreateChirp(t *testing.T) {
 		t.Fatalf("Could not read file: %v", err)
 	}
 
-	expectedData := `{"chirps":{"1":{"id":1,"body":"test chirp"}}}`
+	expectedData := fmt.Sprintf(`{"schema_version":%d,"chirps":{"1":{"id":1,"body":"test chirp","author_id":1,"created_at":"2024-01-10T12:00:00Z","updated_at":"2024-01-10T12:00:00Z"}},"users":{},"sequences":{"chirps":1,"users":0}}`, currentSchemaVersion)
 	if string(data) != expectedData {
 		t.Errorf("Expected data to be '%s', got '%s'", expectedData, string(data))
 	}
 }
 
+func TestDeletedIdsAreNotReused(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev})
+	defer os.Remove(path)
+
+	for _, body := range []string{"first", "second", "third"} {
+		if _, err := db.CreateChirp(body, 1); err != nil {
+			t.Fatalf("CreateChirp resulted in an error: %v", err)
+		}
+	}
+	if err := db.DeleteChirp(2, 1); err != nil {
+		t.Fatalf("DeleteChirp resulted in an error: %v", err)
+	}
+
+	chirp, err := db.CreateChirp("fourth", 1)
+	if err != nil {
+		t.Fatalf("CreateChirp resulted in an error: %v", err)
+	}
+	if chirp.Id != 4 {
+		t.Errorf("Expected the new chirp to get id 4, got %d", chirp.Id)
+	}
+
+	third, err := db.GetChirp(3)
+	if err != nil || third.Body != "third" {
+		t.Errorf("Expected chirp 3 to be untouched, got %v, %v", third, err)
+	}
+}
+
+func TestSequenceMigration(t *testing.T) {
+	path := "./database.test.json"
+	defer os.Remove(path)
+
+	data := `{"chirps":{"1":{"id":1,"body":"first","author_id":1},"3":{"id":3,"body":"third","author_id":1}},"users":{}}`
+	os.WriteFile(path, []byte(data), 0644)
+
+	db, err := NewDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+
+	content, _ := os.ReadFile(path)
+	expectedData := fmt.Sprintf(`{"schema_version":%d,"chirps":{"1":{"id":1,"body":"first","author_id":1},"3":{"id":3,"body":"third","author_id":1}},"users":{},"sequences":{"chirps":3,"users":0}}`, currentSchemaVersion)
+	if string(content) != expectedData {
+		t.Errorf("Expected data to be '%s', got '%s'", expectedData, string(content))
+	}
+
+	chirp, err := db.CreateChirp("fourth", 1)
+	if err != nil {
+		t.Fatalf("CreateChirp resulted in an error: %v", err)
+	}
+	if chirp.Id != 4 {
+		t.Errorf("Expected the new chirp to get id 4, got %d", chirp.Id)
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	path := "./database.test.json"
+	defer os.Remove(path)
+
+	data := `{"chirps":{"2":{"id":2,"body":"second","author_id":1}},"users":{}}`
+	os.WriteFile(path, []byte(data), 0644)
+
+	steps, err := Migrate("json", path, true)
+	if err != nil {
+		t.Fatalf("Migrate resulted in an error: %v", err)
+	}
+	if len(steps) != currentSchemaVersion || steps[0].Version != 1 || steps[0].Changes != "sequences.chirps=2" {
+		t.Errorf("Unexpected migration plan: %v", steps)
+	}
+
+	content, _ := os.ReadFile(path)
+	if string(content) != data {
+		t.Errorf("Expected a dry run to leave the file untouched, got '%s'", string(content))
+	}
+
+	steps, err = Migrate("json", path, false)
+	if err != nil || len(steps) != currentSchemaVersion {
+		t.Fatalf("Migrate returned %v, %v", steps, err)
+	}
+
+	steps, err = Migrate("json", path, true)
+	if err != nil || len(steps) != 0 {
+		t.Errorf("Expected nothing left to migrate, got %v, %v", steps, err)
+	}
+}
+
+func TestNewerSchemaVersionIsRejected(t *testing.T) {
+	path := "./database.test.json"
+	defer os.Remove(path)
+
+	os.WriteFile(path, []byte(`{"schema_version":999,"chirps":{},"users":{}}`), 0644)
+
+	if _, err := NewDB(path, Options{Mode: ModePersistent}); !errors.Is(err, ErrorCorruptFile) {
+		t.Errorf("Expected a file from a newer binary to be rejected, got %v", err)
+	}
+}
+
+// allChirps follows the cursors of GetChirps until the last page.
+func allChirps(s Store) ([]Chirp, error) {
+	chirps := []Chirp{}
+	q := ChirpQuery{}
+	for {
+		page, err := s.GetChirps(q)
+		if err != nil {
+			return nil, err
+		}
+		chirps = append(chirps, page.Chirps...)
+		if page.NextCursor == "" {
+			return chirps, nil
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+func TestGetChirpsPagination(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev})
+	defer os.Remove(path)
+
+	for i := 1; i <= 7; i++ {
+		db.CreateChirp(fmt.Sprintf("chirp %d", i), i%2)
+	}
+	db.DeleteChirp(4, 0)
+
+	testChirpPagination(t, db)
+}
+
+// chirpPages follows the cursors of GetChirps and returns the ids on each
+// page.
+func chirpPages(t *testing.T, s Store, q ChirpQuery) [][]int {
+	t.Helper()
+
+	result := [][]int{}
+	for {
+		page, err := s.GetChirps(q)
+		if err != nil {
+			t.Fatalf("GetChirps(%+v) resulted in an error: %v", q, err)
+		}
+		ids := []int{}
+		for _, chirp := range page.Chirps {
+			ids = append(ids, chirp.Id)
+		}
+		result = append(result, ids)
+		if page.NextCursor == "" {
+			return result
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+// testChirpPagination expects chirps 1-7 with chirp 4 deleted, odd ids by
+// author 1 and even ids by author 0.
+func testChirpPagination(t *testing.T, s Store) {
+	t.Helper()
+
+	pages := func(q ChirpQuery) [][]int { return chirpPages(t, s, q) }
+
+	cases := []struct {
+		q    ChirpQuery
+		want string
+	}{
+		{ChirpQuery{Limit: 2}, "[[1 2] [3 5] [6 7]]"},
+		{ChirpQuery{Limit: 4, Sort: SortDesc}, "[[7 6 5 3] [2 1]]"},
+		{ChirpQuery{Limit: 3, Sort: SortDesc}, "[[7 6 5] [3 2 1]]"},
+		{ChirpQuery{Limit: 2, AuthorId: 1}, "[[1 3] [5 7]]"},
+		{ChirpQuery{}, "[[1 2 3 5 6 7]]"},
+	}
+	for _, c := range cases {
+		if got := fmt.Sprint(pages(c.q)); got != c.want {
+			t.Errorf("GetChirps(%+v) pages = %s, want %s", c.q, got, c.want)
+		}
+	}
+
+	page, _ := s.GetChirps(ChirpQuery{Limit: 2})
+	_, err := s.GetChirps(ChirpQuery{Limit: 2, Sort: SortDesc, Cursor: page.NextCursor})
+	if !errors.Is(err, ErrorInvalidCursor) {
+		t.Errorf("Expected a cursor from another sort order to be rejected, got %v", err)
+	}
+	_, err = s.GetChirps(ChirpQuery{Cursor: "not-a-cursor"})
+	if !errors.Is(err, ErrorInvalidCursor) {
+		t.Errorf("Expected a malformed cursor to be rejected, got %v", err)
+	}
+}
+
+func TestSearchChirps(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev})
+	defer os.Remove(path)
+
+	createSearchChirps(db)
+	testChirpSearch(t, db)
+}
+
+func createSearchChirps(s Store) {
+	s.CreateChirp("The quick brown fox", 1)
+	s.CreateChirp("quick, quick fox jumps", 2)
+	s.CreateChirp("a brown dog sleeps", 1)
+	s.CreateChirp("foxes are quick", 2)
+	s.CreateChirp("the brown quick fox", 1)
+	s.DeleteChirp(3, 1)
+}
+
+// testChirpSearch expects the chirps made by createSearchChirps.
+func testChirpSearch(t *testing.T, s Store) {
+	t.Helper()
+
+	cases := []struct {
+		q    SearchQuery
+		want string
+	}{
+		{SearchQuery{Query: "quick fox"}, "[2 5 1]"},
+		{SearchQuery{Query: "QUICK fox", Limit: 1}, "[2]"},
+		{SearchQuery{Query: `"quick brown"`}, "[1]"},
+		{SearchQuery{Query: `"brown quick" fox`}, "[5]"},
+		{SearchQuery{Query: "fox*", AuthorId: 2}, "[4 2]"},
+		{SearchQuery{Query: "fox* the", AuthorId: 1}, "[5 1]"},
+		{SearchQuery{Query: "dog"}, "[]"},
+		{SearchQuery{Query: "quick cat"}, "[]"},
+	}
+	for _, c := range cases {
+		chirps, err := s.SearchChirps(c.q)
+		if err != nil {
+			t.Fatalf("SearchChirps(%+v) resulted in an error: %v", c.q, err)
+		}
+		ids := []int{}
+		for _, chirp := range chirps {
+			ids = append(ids, chirp.Id)
+		}
+		if got := fmt.Sprint(ids); got != c.want {
+			t.Errorf("SearchChirps(%+v) = %s, want %s", c.q, got, c.want)
+		}
+	}
+
+	for _, query := range []string{"", "  ", `"*"`} {
+		_, err := s.SearchChirps(SearchQuery{Query: query})
+		if !errors.Is(err, ErrorEmptySearch) {
+			t.Errorf("Expected SearchChirps(%q) to fail with ErrorEmptySearch, got %v", query, err)
+		}
+	}
+}
+
 func TestGetChirps(t *testing.T) {
 	path := "./database.test.json"
-	db, _ := NewDB(path)
+	db, _ := NewDB(path, Options{Mode: ModeDev})
 	defer os.Remove(path)
 
 	// Create a chirp
@@ -122,7 +431,7 @@ func TestGetChirps(t *testing.T) {
 	}
 
 	// Get the chirps
-	chirps, err := db.GetChirps()
+	chirps, err := allChirps(db)
 	if err != nil {
 		t.Fatalf("GetChirps resulted in an error: %v", err)
 	}
@@ -137,3 +446,1694 @@ func TestGetChirps(t *testing.T) {
 		t.Errorf("Expected chirp body to be '%s', got '%s'", body, chirps[0].Body)
 	}
 }
+
+func TestWriteAheadLogReplay(t *testing.T) {
+	path := "./database.test.json"
+	opts := Options{Mode: ModeDev, WriteAheadLog: true, CompactEvery: 100}
+	db, err := NewDB(path, opts)
+	defer os.Remove(path)
+	defer os.Remove(path + ".wal")
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+
+	for _, body := range []string{"first", "second", "third"} {
+		if _, err := db.CreateChirp(body, 1); err != nil {
+			t.Fatalf("CreateChirp resulted in an error: %v", err)
+		}
+	}
+	if err := db.DeleteChirp(2, 1); err != nil {
+		t.Fatalf("DeleteChirp resulted in an error: %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if len(data) != 0 {
+		t.Errorf("Expected the snapshot to stay empty before compaction, got '%s'", string(data))
+	}
+
+	// Simulate a crash in the middle of appending an entry.
+	file, _ := os.OpenFile(path+".wal", os.O_APPEND|os.O_WRONLY, 0644)
+	file.WriteString(`{"op":"put_chirp","chirp":{"id":4,"bo`)
+	file.Close()
+
+	opts.Mode = ModePersistent
+	db, err = NewDB(path, opts)
+	if err != nil {
+		t.Fatalf("Reopening resulted in an error: %v", err)
+	}
+
+	if _, err := os.Stat(path + ".wal"); !os.IsNotExist(err) {
+		t.Errorf("Expected the log to be compacted on startup")
+	}
+
+	chirps, err := allChirps(db)
+	if err != nil {
+		t.Fatalf("GetChirps resulted in an error: %v", err)
+	}
+	if len(chirps) != 2 {
+		t.Errorf("Expected 2 chirps after replay, got %d", len(chirps))
+	}
+	if _, err := db.GetChirp(2); !errors.Is(err, ErrorChirpDoesNotExist) {
+		t.Errorf("Expected the deleted chirp to stay deleted, got %v", err)
+	}
+}
+
+// A crash between writing the snapshot and removing the log replays
+// entries the snapshot already holds; that must change nothing.
+func TestWriteAheadLogReplayIsIdempotent(t *testing.T) {
+	path := "./database.test.json"
+	opts := Options{Mode: ModeDev, WriteAheadLog: true, CompactEvery: 100}
+	db, err := NewDB(path, opts)
+	defer os.Remove(path)
+	defer os.Remove(path + ".wal")
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+
+	db.CreateChirp("first", 1)
+	db.UpdateChirp(1, 1, "second")
+	db.UpdateChirp(1, 1, "third")
+	db.CreateChirp("other", 1)
+	db.Close()
+	log, _ := os.ReadFile(path + ".wal")
+
+	// Reopening folds the log into the snapshot; putting it back simulates
+	// a crash before it was removed.
+	opts.Mode = ModePersistent
+	db, err = NewDB(path, opts)
+	if err != nil {
+		t.Fatalf("Reopening resulted in an error: %v", err)
+	}
+	db.Close()
+	os.WriteFile(path+".wal", log, 0644)
+
+	db, err = NewDB(path, opts)
+	if err != nil {
+		t.Fatalf("Reopening resulted in an error: %v", err)
+	}
+	defer db.Close()
+	revisions, _ := db.GetRevisions(1)
+	if len(revisions) != 2 || revisions[0].Body != "first" || revisions[1].Body != "second" {
+		t.Errorf("Expected the replay to keep 2 revisions, got %+v", revisions)
+	}
+	if chirps, _ := allChirps(db); len(chirps) != 2 {
+		t.Errorf("Expected the replay to keep 2 chirps, got %d", len(chirps))
+	}
+}
+
+func TestWriteAheadLogCompaction(t *testing.T) {
+	path := "./database.test.json"
+	db, err := NewDB(path, Options{Mode: ModeDev, WriteAheadLog: true, CompactEvery: 2})
+	defer os.Remove(path)
+	defer os.Remove(path + ".wal")
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+	defer func() { now = time.Now }()
+	now = func() time.Time { return hashtagTestTime }
+
+	db.CreateChirp("first", 1)
+	db.CreateChirp("second", 1)
+
+	if _, err := os.Stat(path + ".wal"); !os.IsNotExist(err) {
+		t.Errorf("Expected the log to be removed after compaction")
+	}
+
+	data, _ := os.ReadFile(path)
+	expectedData := fmt.Sprintf(`{"schema_version":%d,"chirps":{"1":{"id":1,"body":"first","author_id":1,"created_at":"2024-01-10T12:00:00Z","updated_at":"2024-01-10T12:00:00Z"},"2":{"id":2,"body":"second","author_id":1,"created_at":"2024-01-10T12:00:00Z","updated_at":"2024-01-10T12:00:00Z"}},"users":{},"sequences":{"chirps":2,"users":0}}`, currentSchemaVersion)
+	if string(data) != expectedData {
+		t.Errorf("Expected data to be '%s', got '%s'", expectedData, string(data))
+	}
+}
+
+func TestWriteDBLeavesNoTempFiles(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev})
+	defer os.Remove(path)
+
+	db.CreateChirp("test chirp", 1)
+
+	matches, _ := filepath.Glob(path + ".tmp-*")
+	if len(matches) != 0 {
+		t.Errorf("Expected no temp files after writeDB, got %v", matches)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev})
+	defer os.Remove(path)
+
+	const chirpWriters = 50
+	const userWriters = 10
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*chirpWriters+userWriters)
+
+	for i := 0; i < chirpWriters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := db.CreateChirp(fmt.Sprintf("chirp %d", i), 1)
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < userWriters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := db.CreateUser(fmt.Sprintf("user%d@example.com", i), "password")
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < chirpWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := allChirps(db)
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Concurrent call resulted in an error: %v", err)
+		}
+	}
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		t.Fatalf("loadDB resulted in an error: %v", err)
+	}
+
+	if len(dbStructure.Chirps) != chirpWriters {
+		t.Errorf("Expected %d chirps, got %d", chirpWriters, len(dbStructure.Chirps))
+	}
+	if len(dbStructure.Users) != userWriters {
+		t.Errorf("Expected %d users, got %d", userWriters, len(dbStructure.Users))
+	}
+
+	bodies := make(map[string]struct{}, chirpWriters)
+	for _, chirp := range dbStructure.Chirps {
+		bodies[chirp.Body] = struct{}{}
+	}
+	if len(bodies) != chirpWriters {
+		t.Errorf("Expected %d distinct chirp bodies, got %d", chirpWriters, len(bodies))
+	}
+}
+
+func TestDebouncedDurability(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev, Durability: DurabilityDebounced, FlushInterval: time.Hour})
+	defer os.Remove(path)
+	defer func() { now = time.Now }()
+	now = func() time.Time { return hashtagTestTime }
+
+	if _, err := db.CreateChirp("test chirp", 1); err != nil {
+		t.Fatalf("CreateChirp resulted in an error: %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if len(data) != 0 {
+		t.Errorf("Expected the write to be held back, got '%s'", string(data))
+	}
+
+	chirp, err := db.GetChirp(1)
+	if err != nil || chirp.Body != "test chirp" {
+		t.Errorf("Expected the pending chirp to be readable, got %v, %v", chirp, err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close resulted in an error: %v", err)
+	}
+
+	data, _ = os.ReadFile(path)
+	expectedData := fmt.Sprintf(`{"schema_version":%d,"chirps":{"1":{"id":1,"body":"test chirp","author_id":1,"created_at":"2024-01-10T12:00:00Z","updated_at":"2024-01-10T12:00:00Z"}},"users":{},"sequences":{"chirps":1,"users":0}}`, currentSchemaVersion)
+	if string(data) != expectedData {
+		t.Errorf("Expected data to be '%s', got '%s'", expectedData, string(data))
+	}
+}
+
+func TestFailedWriteChangesNothing(t *testing.T) {
+	for _, opts := range []Options{{Mode: ModePersistent}, {Mode: ModePersistent, WriteAheadLog: true}} {
+		dir := filepath.Join(t.TempDir(), "db")
+		os.Mkdir(dir, 0755)
+		db, err := NewDB(filepath.Join(dir, "database.test.json"), opts)
+		if err != nil {
+			t.Fatalf("NewDB resulted in an error: %v", err)
+		}
+		db.CreateUser("walt@breakingbad.com", "123456")
+
+		// Nothing can be written once the directory is gone.
+		os.RemoveAll(dir)
+		if _, err := db.CreateChirp("lost chirp #lost", 1); err == nil {
+			t.Errorf("Expected CreateChirp to fail with the log %v", opts.WriteAheadLog)
+		}
+		if _, err := db.UpdateUser(1, "heisenberg@breakingbad.com", "123456"); err == nil {
+			t.Errorf("Expected UpdateUser to fail with the log %v", opts.WriteAheadLog)
+		}
+		if _, err := db.Login("walt@breakingbad.com", "123456"); err != nil {
+			t.Errorf("Expected the failed update not to change the email, got %v", err)
+		}
+		if _, err := db.GetChirp(1); !errors.Is(err, ErrorChirpDoesNotExist) {
+			t.Errorf("Expected the failed chirp not to be readable, got %v", err)
+		}
+		if page, _ := db.GetChirps(ChirpQuery{Hashtag: "lost"}); len(page.Chirps) != 0 {
+			t.Errorf("Expected the failed chirp not to be indexed, got %+v", page.Chirps)
+		}
+
+		os.Mkdir(dir, 0755)
+		chirp, err := db.CreateChirp("kept chirp", 1)
+		if err != nil || chirp.Id != 1 {
+			t.Errorf("Expected the next write to succeed as chirp 1, got %+v, %v", chirp, err)
+		}
+		db.Close()
+	}
+}
+
+func TestIndexesFollowWrites(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev})
+	defer os.Remove(path)
+
+	user, _ := db.CreateUser("walt@breakingbad.com", "123456")
+	db.StoreRefreshToken(user.Id, "token", time.Hour, Device{})
+	db.UpdateUser(user.Id, "heisenberg@breakingbad.com", "123456")
+
+	if _, err := db.Login("walt@breakingbad.com", "123456"); !errors.Is(err, ErrorUserNotFound) {
+		t.Errorf("Expected the old email to be unindexed, got %v", err)
+	}
+	if _, err := db.Login("heisenberg@breakingbad.com", "123456"); err != nil {
+		t.Errorf("Login with the new email resulted in an error: %v", err)
+	}
+	if session, err := db.ValidateRefreshToken("token"); err != nil || session.UserId != user.Id {
+		t.Errorf("ValidateRefreshToken returned %+v, %v", session, err)
+	}
+	if _, err := db.ValidateRefreshToken(""); err == nil {
+		t.Errorf("Expected an empty refresh token to be rejected")
+	}
+
+	db.CreateChirp("first", 1)
+	db.CreateChirp("second", 2)
+	db.CreateChirp("third", 1)
+	db.DeleteChirp(1, 1)
+
+	page, _ := db.GetChirps(ChirpQuery{AuthorId: 1})
+	chirps := page.Chirps
+	if len(chirps) != 1 || chirps[0].Id != 3 {
+		t.Errorf("Expected only chirp 3 for author 1, got %v", chirps)
+	}
+}
+
+func TestExtractHashtags(t *testing.T) {
+	cases := []struct {
+		body string
+		want string
+	}{
+		{"no tags here", "[]"},
+		{"#Go and #go", "[go]"},
+		{"(#rust), #golang_1!", "[rust golang_1]"},
+		{"a#b ##c #1 &#39; #", "[]"},
+		{"#Café au lait", "[café]"},
+	}
+	for _, c := range cases {
+		if got := fmt.Sprint(ExtractHashtags(c.body)); got != c.want {
+			t.Errorf("ExtractHashtags(%q) = %s, want %s", c.body, got, c.want)
+		}
+	}
+}
+
+func TestHashtags(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev})
+	defer os.Remove(path)
+
+	testHashtags(t, db)
+
+	// Trending survives a reload, which rebuilds the index from the file.
+	defer func() { now = time.Now }()
+	now = func() time.Time { return hashtagTestTime }
+	db, err := NewDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+	trending, _ := db.TrendingHashtags(TrendingQuery{})
+	if got := fmt.Sprint(trending); got != "[{go 2} {rust 2} {golang 1}]" {
+		t.Errorf("Expected trending to survive a reload, got %s", got)
+	}
+}
+
+var hashtagTestTime = time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+func testHashtags(t *testing.T, s Store) {
+	t.Helper()
+
+	defer func() { now = time.Now }()
+	at := func(offset time.Duration) {
+		now = func() time.Time { return hashtagTestTime.Add(offset) }
+	}
+
+	at(-48 * time.Hour)
+	s.CreateChirp("old news #Go", 1)
+	at(-2 * time.Hour)
+	s.CreateChirp("#go #rust together", 2)
+	at(-time.Hour)
+	s.CreateChirp("learning #rust", 1)
+	at(-30 * time.Minute)
+	chirp, _ := s.CreateChirp("more #go, #Go and #golang", 1)
+	at(-10 * time.Minute)
+	s.CreateChirp("#rust again", 2)
+	s.DeleteChirp(5, 2)
+	at(0)
+
+	if got := fmt.Sprint(chirp.Tags()); got != "[go golang]" {
+		t.Errorf("Expected chirp 4 to be tagged [go golang], got %s", got)
+	}
+	stored, _ := s.GetChirp(chirp.Id)
+	if !reflect.DeepEqual(stored, chirp) {
+		t.Errorf("Expected the stored chirp %v to match %v", stored, chirp)
+	}
+
+	feeds := []struct {
+		q    ChirpQuery
+		want string
+	}{
+		{ChirpQuery{Hashtag: "#GO"}, "[1 2 4]"},
+		{ChirpQuery{Hashtag: "go", AuthorId: 1}, "[1 4]"},
+		{ChirpQuery{Hashtag: "go", Sort: SortDesc, Limit: 2}, "[4 2]"},
+		{ChirpQuery{Hashtag: "rust"}, "[2 3]"},
+		{ChirpQuery{Hashtag: "python"}, "[]"},
+	}
+	for _, c := range feeds {
+		page, err := s.GetChirps(c.q)
+		if err != nil {
+			t.Fatalf("GetChirps(%+v) resulted in an error: %v", c.q, err)
+		}
+		ids := []int{}
+		for _, chirp := range page.Chirps {
+			ids = append(ids, chirp.Id)
+		}
+		if got := fmt.Sprint(ids); got != c.want {
+			t.Errorf("GetChirps(%+v) = %s, want %s", c.q, got, c.want)
+		}
+	}
+	if _, err := s.GetChirps(ChirpQuery{Hashtag: "#"}); !errors.Is(err, ErrorInvalidHashtag) {
+		t.Errorf("Expected an empty hashtag to be rejected, got %v", err)
+	}
+
+	trends := []struct {
+		q    TrendingQuery
+		want string
+	}{
+		{TrendingQuery{}, "[{go 2} {rust 2} {golang 1}]"},
+		{TrendingQuery{Window: 90 * time.Minute}, "[{go 1} {golang 1} {rust 1}]"},
+		{TrendingQuery{Limit: 1}, "[{go 2}]"},
+		{TrendingQuery{Window: time.Minute}, "[]"},
+	}
+	for _, c := range trends {
+		trending, err := s.TrendingHashtags(c.q)
+		if err != nil {
+			t.Fatalf("TrendingHashtags(%+v) resulted in an error: %v", c.q, err)
+		}
+		if got := fmt.Sprint(trending); got != c.want {
+			t.Errorf("TrendingHashtags(%+v) = %s, want %s", c.q, got, c.want)
+		}
+	}
+}
+
+func TestHashtagMigration(t *testing.T) {
+	path := "./database.test.json"
+	defer os.Remove(path)
+
+	data := `{"schema_version":1,"chirps":{"1":{"id":1,"body":"#Go rocks","author_id":1},"2":{"id":2,"body":"plain","author_id":1}},"users":{},"sequences":{"chirps":2,"users":0}}`
+	os.WriteFile(path, []byte(data), 0644)
+
+	steps, err := Migrate("json", path, true)
+	if err != nil || len(steps) == 0 || steps[0].Changes != "tagged 1 chirps" {
+		t.Fatalf("Unexpected migration plan: %v, %v", steps, err)
+	}
+
+	db, err := NewDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+
+	page, _ := db.GetChirps(ChirpQuery{Hashtag: "go"})
+	if len(page.Chirps) != 1 || page.Chirps[0].Id != 1 {
+		t.Errorf("Expected chirp 1 to be tagged go, got %v", page.Chirps)
+	}
+	trending, _ := db.TrendingHashtags(TrendingQuery{Window: MaxTrendingWindow})
+	if len(trending) != 0 {
+		t.Errorf("Expected migrated tags not to trend, got %v", trending)
+	}
+}
+
+func TestExtractMentions(t *testing.T) {
+	cases := []struct {
+		body string
+		want string
+	}{
+		{"no mentions", "[]"},
+		{"@Walt. @walt @jesse_p!", "[walt jesse_p]"},
+		{"(@skyler.white), @hank+dea", "[skyler.white hank+dea]"},
+		{"mail walt@breakingbad.com or @ someone", "[]"},
+	}
+	for _, c := range cases {
+		if got := fmt.Sprint(ExtractMentions(c.body)); got != c.want {
+			t.Errorf("ExtractMentions(%q) = %s, want %s", c.body, got, c.want)
+		}
+	}
+}
+
+func TestMentions(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev})
+	defer os.Remove(path)
+
+	testMentions(t, db)
+}
+
+func testMentions(t *testing.T, s Store) {
+	t.Helper()
+
+	s.CreateUser("walt@breakingbad.com", "123456")
+	s.CreateUser("jesse@breakingbad.com", "123456")
+	s.CreateUser("walt@other.com", "123456")
+	s.CreateUser("Skyler@breakingbad.com", "123456")
+
+	cases := []struct {
+		body     string
+		authorId int
+		want     string
+	}{
+		// walt is ambiguous until user 3 changes email.
+		{"hey @Jesse and @walt.", 4, "[2]"},
+		{"cc @skyler, @jesse @jesse @nobody", 2, "[4 2]"},
+		{"mail jesse@breakingbad.com", 1, "[]"},
+		{"@walt again", 4, "[1]"},
+	}
+	for i, c := range cases {
+		if i == 3 {
+			s.UpdateUser(3, "heisenberg@other.com", "123456")
+		}
+		chirp, err := s.CreateChirp(c.body, c.authorId)
+		if err != nil {
+			t.Fatalf("CreateChirp(%q) resulted in an error: %v", c.body, err)
+		}
+		stored, _ := s.GetChirp(chirp.Id)
+		if got := fmt.Sprint(append([]int{}, stored.Mentions...)); got != c.want {
+			t.Errorf("CreateChirp(%q) mentions = %s, want %s", c.body, got, c.want)
+		}
+	}
+
+	feeds := []struct {
+		q    ChirpQuery
+		want string
+	}{
+		{ChirpQuery{MentionId: 2}, "[1 2]"},
+		{ChirpQuery{MentionId: 2, AuthorId: 2}, "[2]"},
+		{ChirpQuery{MentionId: 1}, "[4]"},
+		{ChirpQuery{MentionId: 3}, "[]"},
+	}
+	if user, err := s.GetUser(3); err != nil || user.Email != "heisenberg@other.com" {
+		t.Errorf("Expected GetUser to find user 3, got %+v, %v", user, err)
+	}
+	if _, err := s.GetUser(99); !errors.Is(err, ErrorUserNotFound) {
+		t.Errorf("Expected ErrorUserNotFound for a missing user, got %v", err)
+	}
+	for _, c := range feeds {
+		page, err := s.GetChirps(c.q)
+		if err != nil {
+			t.Fatalf("GetChirps(%+v) resulted in an error: %v", c.q, err)
+		}
+		ids := []int{}
+		for _, chirp := range page.Chirps {
+			ids = append(ids, chirp.Id)
+		}
+		if got := fmt.Sprint(ids); got != c.want {
+			t.Errorf("GetChirps(%+v) = %s, want %s", c.q, got, c.want)
+		}
+	}
+}
+
+func TestMentionMigration(t *testing.T) {
+	path := "./database.test.json"
+	defer os.Remove(path)
+
+	data := `{"schema_version":2,"chirps":{"1":{"id":1,"body":"hi @jesse","author_id":1}},"users":{"1":{"id":1,"email":"walt@breakingbad.com","password":"","is_chirpy_red":false,"refresh_token":""},"2":{"id":2,"email":"jesse@breakingbad.com","password":"","is_chirpy_red":false,"refresh_token":""}},"sequences":{"chirps":1,"users":2}}`
+	os.WriteFile(path, []byte(data), 0644)
+
+	db, err := NewDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+
+	page, _ := db.GetChirps(ChirpQuery{MentionId: 2})
+	if len(page.Chirps) != 1 || page.Chirps[0].Id != 1 {
+		t.Errorf("Expected chirp 1 to mention user 2, got %v", page.Chirps)
+	}
+}
+
+func TestSessionMigration(t *testing.T) {
+	path := "./database.test.json"
+	defer os.Remove(path)
+
+	defer func() { now = time.Now }()
+	now = func() time.Time { return hashtagTestTime }
+
+	data := `{"schema_version":10,"chirps":{},"users":{"1":{"id":1,"email":"walt@breakingbad.com","password":"","is_chirpy_red":false,"refresh_token":"walts"},"2":{"id":2,"email":"jesse@breakingbad.com","password":"","is_chirpy_red":false,"refresh_token":""}},"sequences":{"chirps":0,"users":2}}`
+	os.WriteFile(path, []byte(data), 0644)
+
+	db, err := NewDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+
+	session, err := db.ValidateRefreshToken("walts")
+	if err != nil || session.UserId != 1 || !session.ExpiresAt.Equal(hashtagTestTime.Add(migratedSessionLifetime)) {
+		t.Errorf("Expected walt's refresh token to become a session, got %+v, %v", session, err)
+	}
+	if sessions, _ := db.GetSessions(2); len(sessions) != 0 {
+		t.Errorf("Expected no session for a user without a refresh token, got %v", sessions)
+	}
+
+	content, _ := os.ReadFile(path)
+	if strings.Contains(string(content), "walts") || strings.Contains(string(content), "refresh_token") {
+		t.Errorf("Expected the raw refresh token to be gone, got %s", content)
+	}
+}
+
+func TestThreads(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev})
+	defer os.Remove(path)
+
+	testThreads(t, db)
+
+	// Tombstones survive a reload.
+	db, err := NewDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+	thread, _ := db.GetThread(3, 0)
+	if got := formatThread(thread); got != "1-(2-(3))" {
+		t.Errorf("Expected the thread to survive a reload, got %s", got)
+	}
+}
+
+// formatThread renders a thread as id(replies...), marking deleted nodes
+// with - and nodes cut off by the depth limit with +ReplyCount.
+func formatThread(node ThreadNode) string {
+	s := fmt.Sprint(node.Chirp.Id)
+	if node.Deleted {
+		s += "-"
+	}
+	if len(node.Replies) == 0 {
+		if node.ReplyCount > 0 {
+			s += fmt.Sprintf("+%d", node.ReplyCount)
+		}
+		return s
+	}
+	replies := []string{}
+	for _, reply := range node.Replies {
+		replies = append(replies, formatThread(reply))
+	}
+	return s + "(" + strings.Join(replies, " ") + ")"
+}
+
+func testThreads(t *testing.T, s Store) {
+	t.Helper()
+
+	s.CreateChirp("root", 1)
+	s.CreateReply("reply to 1", 2, 1)
+	s.CreateReply("reply to 2", 1, 2)
+	s.CreateReply("another reply to 1", 3, 1)
+	s.CreateReply("reply to 3", 2, 3)
+	s.CreateChirp("unrelated", 1)
+
+	if _, err := s.CreateReply("reply to nothing", 1, 99); !errors.Is(err, ErrorParentChirpDoesNotExist) {
+		t.Errorf("Expected a reply to a missing chirp to fail, got %v", err)
+	}
+	reply, _ := s.GetChirp(5)
+	if reply.InReplyTo != 3 {
+		t.Errorf("Expected chirp 5 to reply to 3, got %d", reply.InReplyTo)
+	}
+
+	check := func(id int, depth int, want string) {
+		t.Helper()
+		thread, err := s.GetThread(id, depth)
+		if err != nil {
+			t.Fatalf("GetThread(%d, %d) resulted in an error: %v", id, depth, err)
+		}
+		if got := formatThread(thread); got != want {
+			t.Errorf("GetThread(%d, %d) = %s, want %s", id, depth, got, want)
+		}
+	}
+
+	check(5, 0, "1(2(3(5)) 4)")
+	check(1, 1, "1(2+1 4)")
+	check(6, 0, "6")
+
+	s.DeleteChirp(2, 2)
+	check(5, 0, "1(2-(3(5)) 4)")
+	s.DeleteChirp(1, 1)
+	check(4, 0, "1-(2-(3(5)) 4)")
+	s.DeleteChirp(4, 3)
+	check(3, 0, "1-(2-(3(5)))")
+	s.DeleteChirp(5, 2)
+	check(3, 0, "1-(2-(3))")
+
+	if _, err := s.GetThread(1, 0); !errors.Is(err, ErrorChirpDoesNotExist) {
+		t.Errorf("Expected the thread of a deleted chirp to be missing, got %v", err)
+	}
+
+	if _, err := s.CreateReply("late reply", 1, 5); !errors.Is(err, ErrorParentChirpDoesNotExist) {
+		t.Errorf("Expected a reply to a deleted chirp to fail, got %v", err)
+	}
+}
+
+func TestFollows(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev})
+	defer os.Remove(path)
+
+	testFollows(t, db)
+
+	db, err := NewDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+	page, _ := db.GetFollowers(FollowQuery{UserId: 2})
+	if len(page.Users) != 2 || page.Users[0].Id != 1 || page.Users[1].Id != 4 {
+		t.Errorf("Expected followers to survive a reload, got %v", page.Users)
+	}
+}
+
+func testFollows(t *testing.T, s Store) {
+	t.Helper()
+
+	for i := 1; i <= 4; i++ {
+		s.CreateUser(fmt.Sprintf("user%d@example.com", i), "123456")
+	}
+
+	for _, f := range [][2]int{{1, 2}, {1, 3}, {1, 2}, {4, 2}} {
+		if err := s.Follow(f[0], f[1]); err != nil {
+			t.Fatalf("Follow(%d, %d) resulted in an error: %v", f[0], f[1], err)
+		}
+	}
+	if err := s.Follow(1, 1); !errors.Is(err, ErrorCannotFollowSelf) {
+		t.Errorf("Expected following yourself to fail, got %v", err)
+	}
+	if err := s.Follow(1, 99); !errors.Is(err, ErrorUserNotFound) {
+		t.Errorf("Expected following a missing user to fail, got %v", err)
+	}
+
+	userPages := func(list func(FollowQuery) (UserPage, error), q FollowQuery) string {
+		result := [][]int{}
+		for {
+			page, err := list(q)
+			if err != nil {
+				t.Fatalf("Listing %+v resulted in an error: %v", q, err)
+			}
+			ids := []int{}
+			for _, user := range page.Users {
+				ids = append(ids, user.Id)
+			}
+			result = append(result, ids)
+			if page.NextCursor == "" {
+				return fmt.Sprint(result)
+			}
+			q.Cursor = page.NextCursor
+		}
+	}
+	if got := userPages(s.GetFollowing, FollowQuery{UserId: 1}); got != "[[2 3]]" {
+		t.Errorf("Expected user 1 to follow [[2 3]], got %s", got)
+	}
+	if got := userPages(s.GetFollowers, FollowQuery{UserId: 2, Limit: 1}); got != "[[1] [4]]" {
+		t.Errorf("Expected user 2 to be followed by [[1] [4]], got %s", got)
+	}
+	if got := userPages(s.GetFollowers, FollowQuery{UserId: 3}); got != "[[1]]" {
+		t.Errorf("Expected user 3 to be followed by [[1]], got %s", got)
+	}
+	if _, err := s.GetFollowers(FollowQuery{UserId: 99}); !errors.Is(err, ErrorUserNotFound) {
+		t.Errorf("Expected the followers of a missing user to fail, got %v", err)
+	}
+
+	for _, authorId := range []int{2, 3, 4, 2, 3} {
+		s.CreateChirp(fmt.Sprintf("by %d", authorId), authorId)
+	}
+
+	timelines := []struct {
+		q    ChirpQuery
+		want string
+	}{
+		{ChirpQuery{TimelineOf: 1, Sort: SortDesc, Limit: 2}, "[[5 4] [2 1]]"},
+		{ChirpQuery{TimelineOf: 1, Limit: 3}, "[[1 2 4] [5]]"},
+		{ChirpQuery{TimelineOf: 1, AuthorId: 3}, "[[2 5]]"},
+		{ChirpQuery{TimelineOf: 4, Sort: SortDesc}, "[[4 1]]"},
+		{ChirpQuery{TimelineOf: 3}, "[[]]"},
+	}
+	for _, c := range timelines {
+		if got := fmt.Sprint(chirpPages(t, s, c.q)); got != c.want {
+			t.Errorf("GetChirps(%+v) pages = %s, want %s", c.q, got, c.want)
+		}
+	}
+
+	s.Unfollow(1, 3)
+	if err := s.Unfollow(1, 3); err != nil {
+		t.Errorf("Expected unfollowing twice to succeed, got %v", err)
+	}
+	if got := fmt.Sprint(chirpPages(t, s, ChirpQuery{TimelineOf: 1, Sort: SortDesc})); got != "[[4 1]]" {
+		t.Errorf("Expected the timeline to drop unfollowed users, got %s", got)
+	}
+}
+
+func TestLikes(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev})
+	defer os.Remove(path)
+
+	testLikes(t, db)
+
+	db, err := NewDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+	if chirp, _ := db.GetChirp(4); chirp.LikeCount != 1 {
+		t.Errorf("Expected likes to survive a reload, got %d", chirp.LikeCount)
+	}
+}
+
+func testLikes(t *testing.T, s Store) {
+	t.Helper()
+
+	for i := 1; i <= 3; i++ {
+		s.CreateUser(fmt.Sprintf("user%d@example.com", i), "123456")
+	}
+	for i := 1; i <= 4; i++ {
+		s.CreateChirp(fmt.Sprintf("chirp %d", i), 1)
+	}
+
+	for _, like := range []Like{{1, 2}, {1, 3}, {3, 2}, {4, 2}, {4, 3}, {4, 3}} {
+		if err := s.LikeChirp(like.ChirpId, like.UserId); err != nil {
+			t.Fatalf("LikeChirp(%d, %d) resulted in an error: %v", like.ChirpId, like.UserId, err)
+		}
+	}
+	if err := s.LikeChirp(99, 1); !errors.Is(err, ErrorChirpDoesNotExist) {
+		t.Errorf("Expected liking a missing chirp to fail, got %v", err)
+	}
+	if err := s.LikeChirp(1, 99); !errors.Is(err, ErrorUserNotFound) {
+		t.Errorf("Expected a missing user liking a chirp to fail, got %v", err)
+	}
+
+	if chirp, _ := s.GetChirp(4); chirp.LikeCount != 2 {
+		t.Errorf("Expected chirp 4 to have 2 likes, got %d", chirp.LikeCount)
+	}
+	liked, err := s.LikedChirps(2, []int{1, 2, 3, 4, 99})
+	if err != nil {
+		t.Fatalf("LikedChirps resulted in an error: %v", err)
+	}
+	if want := map[int]bool{1: true, 3: true, 4: true}; !reflect.DeepEqual(liked, want) {
+		t.Errorf("LikedChirps(2) = %v, want %v", liked, want)
+	}
+	if liked, _ := s.LikedChirps(3, nil); len(liked) != 0 {
+		t.Errorf("Expected no liked chirps for no ids, got %v", liked)
+	}
+
+	byLikes := ChirpQuery{Sort: SortLikes, Limit: 2}
+	if got := fmt.Sprint(chirpPages(t, s, byLikes)); got != "[[4 1] [3 2]]" {
+		t.Errorf("Expected the most liked chirps first, got %s", got)
+	}
+
+	s.UnlikeChirp(4, 3)
+	if err := s.UnlikeChirp(4, 3); err != nil {
+		t.Errorf("Expected unliking twice to succeed, got %v", err)
+	}
+	if got := fmt.Sprint(chirpPages(t, s, ChirpQuery{Sort: SortLikes, Limit: 1})); got != "[[1] [4] [3] [2]]" {
+		t.Errorf("Expected ties to go newest first, got %s", got)
+	}
+
+	s.DeleteChirp(1, 1)
+	if liked, _ := s.LikedChirps(2, []int{1}); len(liked) != 0 {
+		t.Errorf("Expected likes of a deleted chirp to go, got %v", liked)
+	}
+	if got := fmt.Sprint(chirpPages(t, s, ChirpQuery{Sort: SortLikes})); got != "[[4 3 2]]" {
+		t.Errorf("Expected the deleted chirp to drop out, got %s", got)
+	}
+}
+
+func TestRechirps(t *testing.T) {
+	path := "./database.test.json"
+	opts := Options{Mode: ModeDev, WriteAheadLog: true}
+	db, _ := NewDB(path, opts)
+	defer os.Remove(path)
+	defer os.Remove(path + ".wal")
+
+	testRechirps(t, db)
+
+	// The cascading delete must replay from the log.
+	opts.Mode = ModePersistent
+	db, err := NewDB(path, opts)
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+	if _, err := db.GetChirp(2); !errors.Is(err, ErrorChirpDoesNotExist) {
+		t.Errorf("Expected the rechirp to stay deleted after a reload, got %v", err)
+	}
+	if quote, _ := db.GetChirp(4); quote.QuoteOf != 1 || quote.Shared != nil {
+		t.Errorf("Expected the quote to survive a reload, got %+v", quote)
+	}
+}
+
+func testRechirps(t *testing.T, s Store) {
+	t.Helper()
+
+	for i := 1; i <= 3; i++ {
+		s.CreateUser(fmt.Sprintf("user%d@example.com", i), "123456")
+	}
+	s.CreateChirp("original", 1)
+
+	rechirp, err := s.CreateRechirp(2, 1)
+	if err != nil {
+		t.Fatalf("CreateRechirp resulted in an error: %v", err)
+	}
+	if rechirp.RechirpOf != 1 || rechirp.Body != "" || rechirp.Shared == nil || rechirp.Shared.Body != "original" {
+		t.Errorf("Expected a rechirp embedding chirp 1, got %+v", rechirp)
+	}
+	for _, id := range []int{1, rechirp.Id} {
+		if _, err := s.CreateRechirp(2, id); !errors.Is(err, ErrorAlreadyRechirped) {
+			t.Errorf("Expected rechirping %d again to fail, got %v", id, err)
+		}
+	}
+	if _, err := s.CreateRechirp(2, 99); !errors.Is(err, ErrorSharedChirpDoesNotExist) {
+		t.Errorf("Expected rechirping a missing chirp to fail, got %v", err)
+	}
+
+	// Rechirps stand in for their original.
+	other, _ := s.CreateRechirp(3, rechirp.Id)
+	quote, err := s.CreateQuote("so true", 2, rechirp.Id)
+	if err != nil {
+		t.Fatalf("CreateQuote resulted in an error: %v", err)
+	}
+	reply, _ := s.CreateReply("why?", 3, rechirp.Id)
+	if other.RechirpOf != 1 || quote.QuoteOf != 1 || reply.InReplyTo != 1 {
+		t.Errorf("Expected sharing a rechirp to share chirp 1, got %d, %d and %d", other.RechirpOf, quote.QuoteOf, reply.InReplyTo)
+	}
+	if quote.Shared == nil || quote.Shared.Id != 1 {
+		t.Errorf("Expected the quote to embed chirp 1, got %+v", quote.Shared)
+	}
+	if _, err := s.CreateQuote("huh", 2, 99); !errors.Is(err, ErrorSharedChirpDoesNotExist) {
+		t.Errorf("Expected quoting a missing chirp to fail, got %v", err)
+	}
+
+	page, _ := s.GetChirps(ChirpQuery{AuthorId: 2})
+	if len(page.Chirps) != 2 || page.Chirps[0].Id != rechirp.Id || page.Chirps[1].Id != quote.Id {
+		t.Fatalf("Expected the author listing to hold the rechirp and the quote, got %+v", page.Chirps)
+	}
+	s.LikeChirp(1, 3)
+	if shared := page.Chirps[0].Shared; shared == nil || shared.Body != "original" {
+		t.Errorf("Expected listed rechirps to embed their original, got %+v", shared)
+	}
+	if got, _ := s.GetChirp(rechirp.Id); got.Shared == nil || got.Shared.LikeCount != 1 {
+		t.Errorf("Expected the embedded original to carry its likes, got %+v", got.Shared)
+	}
+
+	s.DeleteChirp(1, 1)
+	for _, id := range []int{rechirp.Id, other.Id} {
+		if _, err := s.GetChirp(id); !errors.Is(err, ErrorChirpDoesNotExist) {
+			t.Errorf("Expected rechirp %d to go with its original, got %v", id, err)
+		}
+	}
+	quote, err = s.GetChirp(quote.Id)
+	if err != nil || quote.QuoteOf != 1 || quote.Shared != nil {
+		t.Errorf("Expected the quote to outlive its original, got %+v, %v", quote, err)
+	}
+	if got := fmt.Sprint(chirpPages(t, s, ChirpQuery{})); got != "[[4 5]]" {
+		t.Errorf("Expected the quote and the reply to remain, got %s", got)
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev})
+	defer os.Remove(path)
+
+	testRevisions(t, db)
+
+	db, err := NewDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+	revisions, _ := db.GetRevisions(3)
+	if len(revisions) != 1 || revisions[0].Body != "draft" {
+		t.Errorf("Expected revisions to survive a reload, got %v", revisions)
+	}
+}
+
+func testRevisions(t *testing.T, s Store) {
+	t.Helper()
+
+	defer func() { now = time.Now }()
+	at := func(offset time.Duration) {
+		now = func() time.Time { return hashtagTestTime.Add(offset) }
+	}
+
+	s.CreateUser("alice@example.com", "123456")
+	s.CreateUser("bob@example.com", "123456")
+
+	at(-2 * time.Hour)
+	s.CreateChirp("hello #go", 1)
+
+	at(-time.Hour)
+	if _, err := s.UpdateChirp(1, 2, "mine now"); !errors.Is(err, ErrorNotChirpAuthor) {
+		t.Errorf("Expected editing another author's chirp to fail, got %v", err)
+	}
+	if _, err := s.UpdateChirp(99, 1, "nothing"); !errors.Is(err, ErrorChirpDoesNotExist) {
+		t.Errorf("Expected editing a missing chirp to fail, got %v", err)
+	}
+	edited, err := s.UpdateChirp(1, 1, "hello #go #rust @bob")
+	if err != nil {
+		t.Fatalf("UpdateChirp resulted in an error: %v", err)
+	}
+	if got := fmt.Sprint(edited.Body, edited.Tags(), edited.Mentions); got != "hello #go #rust @bob[go rust] [2]" {
+		t.Errorf("Expected the edit to re-derive tags and mentions, got %s", got)
+	}
+	if !edited.Hashtags[0].UsedAt.Equal(hashtagTestTime.Add(-2*time.Hour)) || !edited.Hashtags[1].UsedAt.Equal(hashtagTestTime.Add(-time.Hour)) {
+		t.Errorf("Expected kept tags to keep their use time, got %v and %v", edited.Hashtags[0].UsedAt, edited.Hashtags[1].UsedAt)
+	}
+
+	at(0)
+	s.UpdateChirp(1, 1, "bye")
+	s.UpdateChirp(1, 1, "bye")
+
+	revisions, err := s.GetRevisions(1)
+	if err != nil {
+		t.Fatalf("GetRevisions resulted in an error: %v", err)
+	}
+	want := []Revision{
+		{Body: "hello #go", ReplacedAt: hashtagTestTime.Add(-time.Hour)},
+		{Body: "hello #go #rust @bob", ReplacedAt: hashtagTestTime},
+	}
+	if !reflect.DeepEqual(revisions, want) {
+		t.Errorf("GetRevisions(1) = %v, want %v", revisions, want)
+	}
+
+	stored, _ := s.GetChirp(1)
+	if stored.Body != "bye" || len(stored.Hashtags) != 0 || len(stored.Mentions) != 0 {
+		t.Errorf("Expected the stored chirp to follow the edit, got %+v", stored)
+	}
+	for _, q := range []ChirpQuery{{Hashtag: "go"}, {MentionId: 2}} {
+		if page, _ := s.GetChirps(q); len(page.Chirps) != 0 {
+			t.Errorf("Expected GetChirps(%+v) to drop the edited chirp, got %v", q, page.Chirps)
+		}
+	}
+	if found, _ := s.SearchChirps(SearchQuery{Query: "bye"}); len(found) != 1 {
+		t.Errorf("Expected search to find the new body, got %v", found)
+	}
+	if found, _ := s.SearchChirps(SearchQuery{Query: "hello"}); len(found) != 0 {
+		t.Errorf("Expected search to forget the old body, got %v", found)
+	}
+
+	rechirp, _ := s.CreateRechirp(2, 1)
+	if _, err := s.UpdateChirp(rechirp.Id, 2, "edited"); !errors.Is(err, ErrorCannotEditRechirp) {
+		t.Errorf("Expected editing a rechirp to fail, got %v", err)
+	}
+	if revisions, err := s.GetRevisions(rechirp.Id); err != nil || len(revisions) != 0 {
+		t.Errorf("Expected an unedited chirp to have no revisions, got %v, %v", revisions, err)
+	}
+
+	s.CreateChirp("draft", 1)
+	s.UpdateChirp(3, 1, "final")
+
+	s.DeleteChirp(1, 1)
+	if _, err := s.GetRevisions(1); !errors.Is(err, ErrorChirpDoesNotExist) {
+		t.Errorf("Expected the revisions of a deleted chirp to go, got %v", err)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev})
+	defer os.Remove(path)
+
+	testTimestamps(t, db)
+}
+
+func testTimestamps(t *testing.T, s Store) {
+	t.Helper()
+
+	defer func() { now = time.Now }()
+	at := func(offset time.Duration) time.Time {
+		now = func() time.Time { return hashtagTestTime.Add(offset) }
+		return now()
+	}
+	same := func(got *time.Time, want time.Time) bool {
+		return got != nil && got.Equal(want)
+	}
+
+	created := at(-3 * time.Hour)
+	user, _ := s.CreateUser("user@example.com", "123456")
+	if !same(user.CreatedAt, created) || !same(user.UpdatedAt, created) {
+		t.Errorf("Expected a new user to be stamped %v, got %v and %v", created, user.CreatedAt, user.UpdatedAt)
+	}
+	updated := at(-2 * time.Hour)
+	user, _ = s.UpdateUser(user.Id, "new@example.com", "654321")
+	if !same(user.CreatedAt, created) || !same(user.UpdatedAt, updated) {
+		t.Errorf("Expected an updated user to be stamped %v and %v, got %v and %v", created, updated, user.CreatedAt, user.UpdatedAt)
+	}
+	upgraded := at(-90 * time.Minute)
+	if user, _ = s.UpgradeUser(user.Id); !same(user.UpdatedAt, upgraded) {
+		t.Errorf("Expected an upgraded user to be stamped %v, got %v", upgraded, user.UpdatedAt)
+	}
+
+	for _, offset := range []time.Duration{-3 * time.Hour, -2 * time.Hour, -time.Hour, -150 * time.Minute, 0} {
+		at(offset)
+		s.CreateChirp("chirp", 1)
+	}
+	// The clock went back for chirp 4, which is stamped like chirp 3.
+	if chirp, _ := s.GetChirp(4); !same(chirp.CreatedAt, hashtagTestTime.Add(-time.Hour)) {
+		t.Errorf("Expected creation times to never go backwards, got %v", chirp.CreatedAt)
+	}
+
+	edited := at(time.Hour)
+	chirp, _ := s.UpdateChirp(2, 1, "edited")
+	if !same(chirp.CreatedAt, hashtagTestTime.Add(-2*time.Hour)) || !same(chirp.UpdatedAt, edited) {
+		t.Errorf("Expected an edited chirp to be stamped %v, got %v and %v", edited, chirp.CreatedAt, chirp.UpdatedAt)
+	}
+
+	ranges := []struct {
+		q    ChirpQuery
+		want string
+	}{
+		{ChirpQuery{Since: hashtagTestTime.Add(-2 * time.Hour)}, "[[2 3 4 5]]"},
+		{ChirpQuery{Until: hashtagTestTime.Add(-time.Hour)}, "[[1 2]]"},
+		{ChirpQuery{Since: hashtagTestTime.Add(-90 * time.Minute), Until: hashtagTestTime}, "[[3 4]]"},
+		{ChirpQuery{Since: hashtagTestTime, Until: hashtagTestTime}, "[[]]"},
+		{ChirpQuery{Since: hashtagTestTime.Add(time.Minute)}, "[[]]"},
+		{ChirpQuery{Since: hashtagTestTime.Add(-2 * time.Hour), Sort: SortDesc, Limit: 3}, "[[5 4 3] [2]]"},
+		{ChirpQuery{Sort: SortCreatedAt, Limit: 2}, "[[1 2] [3 4] [5]]"},
+	}
+	for _, c := range ranges {
+		if got := fmt.Sprint(chirpPages(t, s, c.q)); got != c.want {
+			t.Errorf("GetChirps(%+v) pages = %s, want %s", c.q, got, c.want)
+		}
+	}
+}
+
+func TestFlags(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev, WriteAheadLog: true})
+	defer os.Remove(path)
+	defer os.Remove(path + ".wal")
+
+	testFlags(t, db)
+
+	db.Close()
+	reloaded, err := NewDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("NewDB resulted in an error: %v", err)
+	}
+	defer reloaded.Close()
+	if flags, _ := reloaded.GetFlags(); fmt.Sprint(flags) != "[{3 [links] 2024-01-10 12:00:00 +0000 UTC}]" {
+		t.Errorf("Expected flags to survive a reload, got %v", flags)
+	}
+}
+
+func testFlags(t *testing.T, s Store) {
+	t.Helper()
+
+	defer func() { now = time.Now }()
+	now = func() time.Time { return hashtagTestTime }
+
+	s.CreateUser("user@example.com", "123456")
+	for _, body := range []string{"one", "two", "three"} {
+		s.CreateChirp(body, 1)
+	}
+
+	if err := s.FlagChirp(99, []string{"spam"}); !errors.Is(err, ErrorChirpDoesNotExist) {
+		t.Errorf("Expected flagging a missing chirp to fail, got %v", err)
+	}
+	if err := s.FlagChirp(1, nil); err != nil {
+		t.Errorf("Expected clearing a missing flag to do nothing, got %v", err)
+	}
+
+	s.FlagChirp(3, []string{"spam"})
+	s.FlagChirp(2, []string{"spam", "links"})
+	s.FlagChirp(1, []string{"links"})
+	s.FlagChirp(3, []string{"links"})
+	s.FlagChirp(1, nil)
+
+	flags, err := s.GetFlags()
+	if err != nil {
+		t.Fatalf("GetFlags resulted in an error: %v", err)
+	}
+	want := []Flag{
+		{ChirpId: 2, Rules: []string{"spam", "links"}, FlaggedAt: hashtagTestTime},
+		{ChirpId: 3, Rules: []string{"links"}, FlaggedAt: hashtagTestTime},
+	}
+	if !reflect.DeepEqual(flags, want) {
+		t.Errorf("GetFlags() = %v, want %v", flags, want)
+	}
+
+	s.DeleteChirp(2, 1)
+	if flags, _ := s.GetFlags(); len(flags) != 1 || flags[0].ChirpId != 3 {
+		t.Errorf("Expected deleting a chirp to drop its flag, got %v", flags)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev})
+	defer os.Remove(path)
+
+	testSessions(t, db)
+
+	defer func() { now = time.Now }()
+	now = func() time.Time { return hashtagTestTime }
+	db, err := NewDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+	if session, err := db.ValidateRefreshToken("laptop-token"); err != nil || session.Label != "laptop" {
+		t.Errorf("Expected sessions to survive a reload, got %+v, %v", session, err)
+	}
+	content, _ := os.ReadFile(path)
+	if strings.Contains(string(content), "-token") {
+		t.Errorf("Expected only token hashes to be stored, got %s", content)
+	}
+}
+
+func testSessions(t *testing.T, s Store) {
+	t.Helper()
+
+	defer func() { now = time.Now }()
+	at := func(offset time.Duration) {
+		now = func() time.Time { return hashtagTestTime.Add(offset) }
+	}
+
+	s.CreateUser("alice@example.com", "123456")
+	s.CreateUser("bob@example.com", "123456")
+
+	if _, err := s.StoreRefreshToken(99, "nobody", time.Hour, Device{}); !errors.Is(err, ErrorUserNotFound) {
+		t.Errorf("Expected a session for a missing user to fail, got %v", err)
+	}
+
+	at(-2 * time.Hour)
+	laptop, err := s.StoreRefreshToken(1, "laptop-token", 24*time.Hour, Device{Label: "laptop", UserAgent: "Firefox"})
+	if err != nil {
+		t.Fatalf("StoreRefreshToken resulted in an error: %v", err)
+	}
+	at(-time.Hour)
+	phone, _ := s.StoreRefreshToken(1, "phone-token", 24*time.Hour, Device{Label: "phone"})
+	s.StoreRefreshToken(2, "bobs-token", 24*time.Hour, Device{})
+
+	// A second login leaves the first device signed in.
+	at(0)
+	session, err := s.ValidateRefreshToken("laptop-token")
+	if err != nil {
+		t.Fatalf("ValidateRefreshToken resulted in an error: %v", err)
+	}
+	want := Session{
+		Id:         laptop.Id,
+		UserId:     1,
+		TokenHash:  laptop.TokenHash,
+		Device:     Device{Label: "laptop", UserAgent: "Firefox"},
+		CreatedAt:  hashtagTestTime.Add(-2 * time.Hour),
+		LastUsedAt: hashtagTestTime,
+		ExpiresAt:  hashtagTestTime.Add(22 * time.Hour),
+	}
+	if !reflect.DeepEqual(session, want) {
+		t.Errorf("ValidateRefreshToken(laptop-token) = %+v, want %+v", session, want)
+	}
+	if laptop.TokenHash == "laptop-token" || laptop.TokenHash == phone.TokenHash {
+		t.Errorf("Expected sessions to keep distinct token hashes, got %q and %q", laptop.TokenHash, phone.TokenHash)
+	}
+
+	sessions, _ := s.GetSessions(1)
+	if len(sessions) != 2 || sessions[0].Id != laptop.Id || sessions[1].Id != phone.Id || !sessions[0].LastUsedAt.Equal(hashtagTestTime) {
+		t.Errorf("Expected alice's two sessions, got %+v", sessions)
+	}
+
+	if err := s.RevokeSession(2, phone.Id); !errors.Is(err, ErrorSessionNotFound) {
+		t.Errorf("Expected revoking another user's session to fail, got %v", err)
+	}
+	if err := s.RevokeSession(1, phone.Id); err != nil {
+		t.Fatalf("RevokeSession resulted in an error: %v", err)
+	}
+	if _, err := s.ValidateRefreshToken("phone-token"); !errors.Is(err, ErrorInvalidRefreshToken) {
+		t.Errorf("Expected a revoked session's token to be rejected, got %v", err)
+	}
+	if err := s.RevokeRefreshToken("bobs-token"); err != nil {
+		t.Fatalf("RevokeRefreshToken resulted in an error: %v", err)
+	}
+	if err := s.RevokeRefreshToken("bobs-token"); !errors.Is(err, ErrorInvalidRefreshToken) {
+		t.Errorf("Expected revoking a token twice to fail, got %v", err)
+	}
+	if sessions, _ := s.GetSessions(1); len(sessions) != 1 || sessions[0].Id != laptop.Id {
+		t.Errorf("Expected only the laptop session to be left, got %+v", sessions)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev, WriteAheadLog: true})
+	defer os.Remove(path)
+	defer os.Remove(path + ".wal")
+
+	testSessionExpiry(t, db)
+
+	defer func() { now = time.Now }()
+	now = func() time.Time { return hashtagTestTime.Add(2 * time.Hour) }
+	db.Close()
+	reloaded, err := NewDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("NewDB resulted in an error: %v", err)
+	}
+	defer reloaded.Close()
+	if n, _ := reloaded.PurgeExpiredSessions(); n != 0 {
+		t.Errorf("Expected the purge to survive a reload, purged %d more", n)
+	}
+}
+
+func testSessionExpiry(t *testing.T, s Store) {
+	t.Helper()
+
+	defer func() { now = time.Now }()
+	at := func(offset time.Duration) {
+		now = func() time.Time { return hashtagTestTime.Add(offset) }
+	}
+
+	s.CreateUser("user@example.com", "123456")
+	at(0)
+	s.StoreRefreshToken(1, "short-token", time.Hour, Device{})
+	s.StoreRefreshToken(1, "long-token", 3*time.Hour, Device{})
+
+	at(time.Hour - time.Nanosecond)
+	if _, err := s.ValidateRefreshToken("short-token"); err != nil {
+		t.Errorf("Expected a token to be valid until it expires, got %v", err)
+	}
+
+	at(time.Hour)
+	if _, err := s.ValidateRefreshToken("short-token"); !errors.Is(err, ErrorRefreshTokenExpired) {
+		t.Errorf("Expected an expired token to be rejected, got %v", err)
+	}
+	if sessions, _ := s.GetSessions(1); len(sessions) != 1 || sessions[0].Id != 2 {
+		t.Errorf("Expected expired sessions to be hidden, got %+v", sessions)
+	}
+
+	at(2 * time.Hour)
+	n, err := s.PurgeExpiredSessions()
+	if err != nil || n != 1 {
+		t.Errorf("PurgeExpiredSessions() = %d, %v, want 1", n, err)
+	}
+	if _, err := s.ValidateRefreshToken("short-token"); !errors.Is(err, ErrorInvalidRefreshToken) {
+		t.Errorf("Expected a purged token to be unknown, got %v", err)
+	}
+	if session, err := s.ValidateRefreshToken("long-token"); err != nil || !session.LastUsedAt.Equal(hashtagTestTime.Add(2*time.Hour)) {
+		t.Errorf("Expected the unexpired session to be kept, got %+v, %v", session, err)
+	}
+	if n, _ := s.PurgeExpiredSessions(); n != 0 {
+		t.Errorf("Expected nothing left to purge, purged %d", n)
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev, WriteAheadLog: true})
+	defer os.Remove(path)
+	defer os.Remove(path + ".wal")
+
+	testRefreshTokenRotation(t, db)
+
+	// Rotated tokens are still recognised after a reload.
+	defer func() { now = time.Now }()
+	now = func() time.Time { return hashtagTestTime }
+	db.Close()
+	reloaded, err := NewDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("NewDB resulted in an error: %v", err)
+	}
+	defer reloaded.Close()
+	if _, err := reloaded.RotateRefreshToken("bob-1", "bob-3"); !errors.Is(err, ErrorRefreshTokenReused) {
+		t.Errorf("Expected reuse to be detected after a reload, got %v", err)
+	}
+}
+
+func testRefreshTokenRotation(t *testing.T, s Store) {
+	t.Helper()
+
+	defer func() { now = time.Now }()
+	now = func() time.Time { return hashtagTestTime }
+
+	s.CreateUser("alice@example.com", "123456")
+	s.CreateUser("bob@example.com", "123456")
+	phone, _ := s.StoreRefreshToken(1, "phone-1", time.Hour, Device{Label: "phone"})
+	laptop, _ := s.StoreRefreshToken(1, "laptop-1", time.Hour, Device{Label: "laptop"})
+	s.StoreRefreshToken(2, "bob-1", time.Hour, Device{})
+
+	rotated, err := s.RotateRefreshToken("phone-1", "phone-2")
+	if err != nil {
+		t.Fatalf("RotateRefreshToken resulted in an error: %v", err)
+	}
+	if rotated.Id != phone.Id || rotated.TokenHash == phone.TokenHash || !rotated.ExpiresAt.Equal(phone.ExpiresAt) {
+		t.Errorf("Expected the session to get a new token and keep its expiry, got %+v", rotated)
+	}
+	if _, err := s.RotateRefreshToken("phone-2", "phone-3"); err != nil {
+		t.Fatalf("Rotating the new token resulted in an error: %v", err)
+	}
+	if _, err := s.RotateRefreshToken("unknown", "phone-4"); !errors.Is(err, ErrorInvalidRefreshToken) {
+		t.Errorf("Expected an unknown token to be rejected, got %v", err)
+	}
+
+	// Replaying an earlier token revokes the whole family, including the
+	// token the legitimate holder has now.
+	revoked, err := s.ValidateRefreshToken("phone-1")
+	if !errors.Is(err, ErrorRefreshTokenReused) || revoked.Id != phone.Id || revoked.UserId != 1 {
+		t.Errorf("Expected reuse of phone-1 to revoke session %d, got %+v, %v", phone.Id, revoked, err)
+	}
+	if _, err := s.RotateRefreshToken("phone-3", "phone-4"); !errors.Is(err, ErrorInvalidRefreshToken) {
+		t.Errorf("Expected the family's latest token to be revoked too, got %v", err)
+	}
+	if _, err := s.RotateRefreshToken("phone-2", "phone-4"); !errors.Is(err, ErrorInvalidRefreshToken) {
+		t.Errorf("Expected a revoked family to be forgotten, got %v", err)
+	}
+
+	if sessions, _ := s.GetSessions(1); len(sessions) != 1 || sessions[0].Id != laptop.Id {
+		t.Errorf("Expected other sessions to be kept, got %+v", sessions)
+	}
+	s.RotateRefreshToken("bob-1", "bob-2")
+}
+
+func TestRotatedTokensAreCapped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.test.json")
+	db, err := NewDB(path, Options{Mode: ModeDev, WriteAheadLog: true})
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+	defer db.Close()
+
+	testRotatedTokensAreCapped(t, db)
+}
+
+// testRotatedTokensAreCapped refreshes one session past maxRotatedTokens and
+// checks only the newest earlier tokens are still recognised as reused.
+func testRotatedTokensAreCapped(t *testing.T, s Store) {
+	t.Helper()
+
+	defer func() { now = time.Now }()
+	now = func() time.Time { return hashtagTestTime }
+
+	s.CreateUser("alice@example.com", "123456")
+	s.StoreRefreshToken(1, "phone-0", time.Hour, Device{})
+	var session Session
+	for i := 1; i <= maxRotatedTokens+1; i++ {
+		var err error
+		session, err = s.RotateRefreshToken(fmt.Sprintf("phone-%d", i-1), fmt.Sprintf("phone-%d", i))
+		if err != nil {
+			t.Fatalf("Rotation %d resulted in an error: %v", i, err)
+		}
+	}
+	if len(session.Rotated) > maxRotatedTokens {
+		t.Errorf("Expected at most %d rotated hashes, got %d", maxRotatedTokens, len(session.Rotated))
+	}
+
+	if _, err := s.ValidateRefreshToken("phone-0"); !errors.Is(err, ErrorInvalidRefreshToken) {
+		t.Errorf("Expected a token past the cap to be forgotten, got %v", err)
+	}
+	if _, err := s.ValidateRefreshToken("phone-1"); !errors.Is(err, ErrorRefreshTokenReused) {
+		t.Errorf("Expected the oldest remembered token to count as reused, got %v", err)
+	}
+}
+
+func TestTokenKeying(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.test.json")
+	testTokenKeying(t, func(key []byte) (Store, error) {
+		return NewDB(path, Options{Mode: ModePersistent, WriteAheadLog: true, TokenKey: key})
+	})
+}
+
+// testTokenKeying opens a store without a key, then with one, checking the
+// refresh tokens issued before are rekeyed rather than lost.
+func testTokenKeying(t *testing.T, open func(key []byte) (Store, error)) {
+	t.Helper()
+
+	defer func() { now = time.Now }()
+	now = func() time.Time { return hashtagTestTime }
+
+	s, err := open(nil)
+	if err != nil {
+		t.Fatalf("Opening without a key resulted in an error: %v", err)
+	}
+	s.CreateUser("alice@example.com", "123456")
+	s.StoreRefreshToken(1, "phone-1", time.Hour, Device{Label: "phone"})
+	s.RotateRefreshToken("phone-1", "phone-2")
+	s.StoreRefreshToken(1, "laptop-1", time.Hour, Device{Label: "laptop"})
+	if sessions, _ := s.GetSessions(1); len(sessions) != 2 || sessions[0].TokenHash != hashRefreshToken("phone-2") {
+		t.Errorf("Expected plain hashes without a key, got %+v", sessions)
+	}
+	s.Close()
+
+	key := []byte("token-key")
+	for i := 0; i < 2; i++ {
+		s, err = open(key)
+		if err != nil {
+			t.Fatalf("Opening with a key resulted in an error: %v", err)
+		}
+		sessions, _ := s.GetSessions(1)
+		if len(sessions) != 2 || sessions[0].TokenHash == hashRefreshToken("phone-2") {
+			t.Errorf("Expected the hashes to be keyed, got %+v", sessions)
+		}
+		if _, err := s.ValidateRefreshToken("laptop-1"); err != nil {
+			t.Errorf("Expected a token issued before keying to stay valid, got %v", err)
+		}
+		s.Close()
+	}
+
+	s, err = open(key)
+	if err != nil {
+		t.Fatalf("Opening with a key resulted in an error: %v", err)
+	}
+	if _, err := s.RotateRefreshToken("phone-1", "phone-3"); !errors.Is(err, ErrorRefreshTokenReused) {
+		t.Errorf("Expected a token rotated before keying to count as reused, got %v", err)
+	}
+	s.Close()
+
+	if _, err := open([]byte("another-key")); !errors.Is(err, ErrorTokenKeyMismatch) {
+		t.Errorf("Expected another key to be refused, got %v", err)
+	}
+
+	s, err = open(key)
+	if err != nil {
+		t.Fatalf("Opening with a key resulted in an error: %v", err)
+	}
+	defer s.Close()
+	session, _ := s.StoreRefreshToken(1, "tablet-1", time.Hour, Device{Label: "tablet"})
+	if session.TokenHash == hashRefreshToken("tablet-1") {
+		t.Errorf("Expected a keyed store to keep keying new tokens")
+	}
+	if _, err := s.ValidateRefreshToken("tablet-1"); err != nil {
+		t.Errorf("Expected a token issued under the key to be valid, got %v", err)
+	}
+	if err := s.RevokeRefreshToken("tablet-1"); err != nil {
+		t.Errorf("RevokeRefreshToken resulted in an error: %v", err)
+	}
+	if err := s.RevokeRefreshToken("tablet-1"); !errors.Is(err, ErrorInvalidRefreshToken) {
+		t.Errorf("Expected a revoked token to be invalid, got %v", err)
+	}
+}
+
+func TestRevokeAllTokens(t *testing.T) {
+	path := "./database.test.json"
+	db, _ := NewDB(path, Options{Mode: ModeDev, WriteAheadLog: true})
+	defer os.Remove(path)
+	defer os.Remove(path + ".wal")
+
+	testRevokeAllTokens(t, db)
+
+	// Versions and revoked sessions survive a reload.
+	defer func() { now = time.Now }()
+	now = func() time.Time { return hashtagTestTime }
+	db.Close()
+	reloaded, err := NewDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("NewDB resulted in an error: %v", err)
+	}
+	defer reloaded.Close()
+	if version, _ := reloaded.TokenVersion(1); version != 1 {
+		t.Errorf("Expected token version 1 after a reload, got %d", version)
+	}
+	if _, err := reloaded.ValidateRefreshToken("alice-phone"); !errors.Is(err, ErrorInvalidRefreshToken) {
+		t.Errorf("Expected a revoked session to stay revoked after a reload, got %v", err)
+	}
+}
+
+func testRevokeAllTokens(t *testing.T, s Store) {
+	t.Helper()
+
+	defer func() { now = time.Now }()
+	now = func() time.Time { return hashtagTestTime }
+
+	s.CreateUser("alice@example.com", "123456")
+	s.CreateUser("bob@example.com", "123456")
+	s.StoreRefreshToken(1, "alice-phone", time.Hour, Device{Label: "phone"})
+	s.StoreRefreshToken(1, "alice-laptop", time.Hour, Device{Label: "laptop"})
+	s.StoreRefreshToken(2, "bob-phone", time.Hour, Device{Label: "phone"})
+
+	user, err := s.UpdateUser(1, "alice@example.org", "123456")
+	if err != nil {
+		t.Fatalf("UpdateUser resulted in an error: %v", err)
+	}
+	if sessions, _ := s.GetSessions(1); user.TokenVersion != 0 || len(sessions) != 2 {
+		t.Errorf("Expected keeping the password to keep the sessions, got version %d and %+v", user.TokenVersion, sessions)
+	}
+
+	user, err = s.UpdateUser(1, "alice@example.org", "654321")
+	if err != nil {
+		t.Fatalf("UpdateUser resulted in an error: %v", err)
+	}
+	if sessions, _ := s.GetSessions(1); user.TokenVersion != 1 || len(sessions) != 0 {
+		t.Errorf("Expected a new password to sign alice out everywhere, got version %d and %+v", user.TokenVersion, sessions)
+	}
+	if _, err := s.ValidateRefreshToken("alice-laptop"); !errors.Is(err, ErrorInvalidRefreshToken) {
+		t.Errorf("Expected alice's refresh tokens to be revoked, got %v", err)
+	}
+	if version, _ := s.TokenVersion(1); version != 1 {
+		t.Errorf("Expected alice's token version to be 1, got %d", version)
+	}
+
+	if _, err := s.ValidateRefreshToken("bob-phone"); err != nil {
+		t.Errorf("Expected bob's session to be kept, got %v", err)
+	}
+	if err := s.RevokeAllTokens(2); err != nil {
+		t.Fatalf("RevokeAllTokens resulted in an error: %v", err)
+	}
+	if sessions, _ := s.GetSessions(2); len(sessions) != 0 {
+		t.Errorf("Expected bob to be signed out everywhere, got %+v", sessions)
+	}
+	if version, _ := s.TokenVersion(2); version != 1 {
+		t.Errorf("Expected bob's token version to be 1, got %d", version)
+	}
+
+	if err := s.RevokeAllTokens(99); !errors.Is(err, ErrorUserNotFound) {
+		t.Errorf("Expected ErrorUserNotFound for a missing user, got %v", err)
+	}
+	if _, err := s.TokenVersion(99); !errors.Is(err, ErrorUserNotFound) {
+		t.Errorf("Expected ErrorUserNotFound for a missing user, got %v", err)
+	}
+}
+
+func newBenchmarkDB(b *testing.B, opts Options, chirps int) *DB {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "database.bench.json")
+	opts.Mode = ModeDev
+	db, err := NewDB(path, opts)
+	if err != nil {
+		b.Fatalf("NewDB resulted in an error: %v", err)
+	}
+	for i := 0; i < chirps; i++ {
+		db.CreateChirp(fmt.Sprintf("chirp number %d", i), i%50)
+	}
+	b.Cleanup(func() { db.Close() })
+	return db
+}
+
+// BenchmarkLoadDB measures what every read cost before DB kept the decoded
+// file in memory, for comparison with BenchmarkGetChirp.
+func BenchmarkLoadDB(b *testing.B) {
+	db := newBenchmarkDB(b, Options{Durability: DurabilityDebounced}, 10000)
+	db.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.loadDB()
+	}
+}
+
+func BenchmarkGetChirp(b *testing.B) {
+	db := newBenchmarkDB(b, Options{Durability: DurabilityDebounced}, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.GetChirp(i%10000 + 1)
+	}
+}
+
+func BenchmarkGetChirpsPageByAuthor(b *testing.B) {
+	db := newBenchmarkDB(b, Options{Durability: DurabilityDebounced}, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.GetChirps(ChirpQuery{AuthorId: i % 50})
+	}
+}
+
+func BenchmarkCreateChirpSync(b *testing.B) {
+	db := newBenchmarkDB(b, Options{Durability: DurabilitySync}, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.CreateChirp("benchmark chirp", 1)
+	}
+}
+
+func BenchmarkCreateChirpDebounced(b *testing.B) {
+	db := newBenchmarkDB(b, Options{Durability: DurabilityDebounced}, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.CreateChirp("benchmark chirp", 1)
+	}
+}
+
+func BenchmarkCreateChirpWriteAheadLog(b *testing.B) {
+	db := newBenchmarkDB(b, Options{WriteAheadLog: true}, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.CreateChirp("benchmark chirp", 1)
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "database.json")
+	backupDir := filepath.Join(dir, "backups")
+
+	db, err := NewDB(path, Options{Mode: ModeDev, WriteAheadLog: true})
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+
+	db.CreateChirp("before backup", 1)
+
+	var backup string
+	for i := 0; i < 3; i++ {
+		backup, err = db.Backup(backupDir, 2)
+		if err != nil {
+			t.Fatalf("Backup resulted in an error: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	backups, _ := filepath.Glob(filepath.Join(backupDir, "database-*.json"))
+	if len(backups) != 2 {
+		t.Errorf("Expected rotation to keep 2 backups, got %v", backups)
+	}
+
+	db.CreateChirp("after backup", 1)
+
+	if err := Restore("json", backup, path); err != nil {
+		t.Fatalf("Restore resulted in an error: %v", err)
+	}
+
+	db, err = NewDB(path, Options{Mode: ModePersistent, WriteAheadLog: true})
+	if err != nil {
+		t.Fatalf("NewDB(%s) resulted in an error %v", path, err)
+	}
+
+	chirps, _ := allChirps(db)
+	if len(chirps) != 1 || chirps[0].Body != "before backup" {
+		t.Errorf("Expected only the chirp from before the backup, got %v", chirps)
+	}
+
+	os.WriteFile(backup, []byte(`{"chirps": {"1": {"id": 2}}}`), 0644)
+	if err := Restore("json", backup, path); !errors.Is(err, ErrorCorruptFile) {
+		t.Errorf("Expected restoring a corrupt backup to fail, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// Flag holds a chirp for review by the moderation rules that matched it.
+type Flag struct {
+	ChirpId int      `json:"chirp_id"`
+	Rules   []string `json:"rules"`
+	// FlaggedAt is when the chirp was last flagged.
+	FlaggedAt time.Time `json:"flagged_at"`
+}
+
+// FlagChirp holds chirpId for review by rules, replacing any earlier flag.
+// No rules clears the flag.
+func (db *DB) FlagChirp(chirpId int, rules []string) error {
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, ok := db.data.Chirps[chirpId]; !ok {
+		return ErrorChirpDoesNotExist
+	}
+	if _, ok := db.data.Flags[chirpId]; !ok && len(rules) == 0 {
+		return nil
+	}
+
+	flag := Flag{ChirpId: chirpId}
+	if len(rules) > 0 {
+		flag.Rules = append([]string{}, rules...)
+		flag.FlaggedAt = now().UTC()
+	}
+
+	err := db.save(walEntry{Op: opFlagChirp, Flag: &flag})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetFlags returns the flagged chirps, by chirp id.
+func (db *DB) GetFlags() ([]Flag, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	flags := make([]Flag, 0, len(db.data.Flags))
+	for _, flag := range db.data.Flags {
+		flag.Rules = append([]string{}, flag.Rules...)
+		flags = append(flags, flag)
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].ChirpId < flags[j].ChirpId })
+	return flags, nil
+}
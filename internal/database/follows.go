@@ -0,0 +1,115 @@
+package database
+
+import (
+	"errors"
+)
+
+var ErrorCannotFollowSelf = errors.New("Users can't follow themselves")
+
+const (
+	DefaultUserLimit = 50
+	MaxUserLimit     = 100
+)
+
+type Follow struct {
+	FollowerId int `json:"follower_id"`
+	FolloweeId int `json:"followee_id"`
+}
+
+// FollowQuery selects one page of the followers or followees of UserId in
+// ascending id order.
+type FollowQuery struct {
+	UserId int
+	Limit  int
+	// Cursor is the NextCursor of the previous page, or empty for the first.
+	Cursor string
+}
+
+type UserPage struct {
+	Users []User
+	// NextCursor fetches the page after this one. It is empty on the last
+	// page.
+	NextCursor string
+}
+
+func (q FollowQuery) normalize() (FollowQuery, cursor, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultUserLimit
+	}
+	q.Limit = min(q.Limit, MaxUserLimit)
+
+	c, err := decodeCursor(q.Cursor, SortAsc)
+	return q, c, err
+}
+
+// Follow makes followerId follow followeeId. Following someone twice is not
+// an error.
+func (db *DB) Follow(followerId int, followeeId int) error {
+	if followerId == followeeId {
+		return ErrorCannotFollowSelf
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	for _, id := range []int{followerId, followeeId} {
+		if _, ok := db.data.Users[id]; !ok {
+			return ErrorUserNotFound
+		}
+	}
+
+	err := db.save(walEntry{Op: opFollow, Follow: &Follow{FollowerId: followerId, FolloweeId: followeeId}})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Unfollow undoes Follow. Unfollowing someone not followed is not an error.
+func (db *DB) Unfollow(followerId int, followeeId int) error {
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, ok := db.data.Users[followeeId]; !ok {
+		return ErrorUserNotFound
+	}
+
+	err := db.save(walEntry{Op: opUnfollow, Follow: &Follow{FollowerId: followerId, FolloweeId: followeeId}})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (db *DB) GetFollowers(q FollowQuery) (UserPage, error) {
+	return db.userPage(q, func() []int { return db.followers[q.UserId] })
+}
+
+func (db *DB) GetFollowing(q FollowQuery) (UserPage, error) {
+	return db.userPage(q, func() []int { return db.data.Follows[q.UserId] })
+}
+
+// userPage pages through the ascending user ids returned by ids, which is
+// called with mux held.
+func (db *DB) userPage(q FollowQuery, ids func() []int) (UserPage, error) {
+	q, c, err := q.normalize()
+	if err != nil {
+		return UserPage{}, err
+	}
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	if _, ok := db.data.Users[q.UserId]; !ok {
+		return UserPage{}, ErrorUserNotFound
+	}
+
+	pageIds, next := pageIds([][]int{ids()}, q.Limit, c)
+	users := make([]User, 0, len(pageIds))
+	for _, id := range pageIds {
+		users = append(users, db.data.Users[id])
+	}
+
+	return UserPage{Users: users, NextCursor: next}, nil
+}
@@ -0,0 +1,194 @@
+package database
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var ErrorInvalidHashtag = errors.New("Invalid hashtag")
+
+const (
+	DefaultTrendingWindow = 24 * time.Hour
+	MaxTrendingWindow     = 7 * 24 * time.Hour
+	DefaultTrendingLimit  = 10
+	MaxTrendingLimit      = 50
+)
+
+// Hashtag is a tag used by a chirp. UsedAt is when the chirp started using
+// it; it is nil for chirps tagged by a migration, which never trend.
+type Hashtag struct {
+	Tag    string     `json:"tag"`
+	UsedAt *time.Time `json:"used_at,omitempty"`
+}
+
+// TrendingHashtag is a tag and the number of chirps that used it within the
+// requested window.
+type TrendingHashtag struct {
+	Tag   string
+	Count int
+}
+
+// hashtagPattern matches a # that starts a word, so "a#b" and "&#39;" are
+// not tags.
+var hashtagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&#])#([\p{L}\p{N}_]+)`)
+
+// NormalizeHashtag returns the stored form of tag, with or without its
+// leading #.
+func NormalizeHashtag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimPrefix(tag, "#"))
+	if tag == "" || strings.IndexFunc(tag, unicode.IsLetter) < 0 {
+		return "", ErrorInvalidHashtag
+	}
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			return "", ErrorInvalidHashtag
+		}
+	}
+	return tag, nil
+}
+
+// ExtractHashtags returns the distinct tags in body in the order they first
+// appear. A tag needs at least one letter, so "#1" is not one.
+func ExtractHashtags(body string) []string {
+	tags := []string{}
+	seen := make(map[string]bool)
+	for _, match := range hashtagPattern.FindAllStringSubmatch(body, -1) {
+		tag, err := NormalizeHashtag(match[1])
+		if err != nil || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// newHashtags stamps the tags of body with usedAt.
+func newHashtags(body string, usedAt time.Time) []Hashtag {
+	hashtags := []Hashtag{}
+	for _, tag := range ExtractHashtags(body) {
+		hashtags = append(hashtags, Hashtag{Tag: tag, UsedAt: &usedAt})
+	}
+	if len(hashtags) == 0 {
+		return nil
+	}
+	return hashtags
+}
+
+// Tags returns just the tag names of the chirp.
+func (c Chirp) Tags() []string {
+	tags := make([]string, 0, len(c.Hashtags))
+	for _, hashtag := range c.Hashtags {
+		tags = append(tags, hashtag.Tag)
+	}
+	return tags
+}
+
+// TrendingQuery asks for the tags used most in the Window up to now.
+type TrendingQuery struct {
+	Window time.Duration
+	Limit  int
+}
+
+func (q TrendingQuery) normalize() TrendingQuery {
+	if q.Window <= 0 {
+		q.Window = DefaultTrendingWindow
+	}
+	q.Window = min(q.Window, MaxTrendingWindow)
+	if q.Limit <= 0 {
+		q.Limit = DefaultTrendingLimit
+	}
+	q.Limit = min(q.Limit, MaxTrendingLimit)
+	return q
+}
+
+// hashtagUse is one entry of the trending index.
+type hashtagUse struct {
+	at      time.Time
+	tag     string
+	chirpId int
+}
+
+func (u hashtagUse) before(other hashtagUse) bool {
+	if !u.at.Equal(other.at) {
+		return u.at.Before(other.at)
+	}
+	if u.chirpId != other.chirpId {
+		return u.chirpId < other.chirpId
+	}
+	return u.tag < other.tag
+}
+
+func (db *DB) indexHashtags(chirp Chirp) {
+	for _, hashtag := range chirp.Hashtags {
+		db.chirpsByHashtag[hashtag.Tag] = insertId(db.chirpsByHashtag[hashtag.Tag], chirp.Id)
+		if hashtag.UsedAt == nil {
+			continue
+		}
+		use := hashtagUse{at: *hashtag.UsedAt, tag: hashtag.Tag, chirpId: chirp.Id}
+		i := sort.Search(len(db.hashtagUses), func(i int) bool { return use.before(db.hashtagUses[i]) })
+		db.hashtagUses = append(db.hashtagUses, hashtagUse{})
+		copy(db.hashtagUses[i+1:], db.hashtagUses[i:])
+		db.hashtagUses[i] = use
+	}
+}
+
+func (db *DB) unindexHashtags(chirp Chirp) {
+	for _, hashtag := range chirp.Hashtags {
+		removeFromIndex(db.chirpsByHashtag, hashtag.Tag, chirp.Id)
+		if hashtag.UsedAt == nil {
+			continue
+		}
+		use := hashtagUse{at: *hashtag.UsedAt, tag: hashtag.Tag, chirpId: chirp.Id}
+		i := sort.Search(len(db.hashtagUses), func(i int) bool { return !db.hashtagUses[i].before(use) })
+		if i < len(db.hashtagUses) && !use.before(db.hashtagUses[i]) {
+			db.hashtagUses = append(db.hashtagUses[:i], db.hashtagUses[i+1:]...)
+		}
+	}
+}
+
+// rankTrending orders tags by use count, breaking ties by the most recent
+// use and then alphabetically.
+func rankTrending(counts map[string]int, lastUsed map[string]time.Time, limit int) []TrendingHashtag {
+	trending := make([]TrendingHashtag, 0, len(counts))
+	for tag, count := range counts {
+		trending = append(trending, TrendingHashtag{Tag: tag, Count: count})
+	}
+	sort.Slice(trending, func(i, j int) bool {
+		a, b := trending[i], trending[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if !lastUsed[a.Tag].Equal(lastUsed[b.Tag]) {
+			return lastUsed[a.Tag].After(lastUsed[b.Tag])
+		}
+		return a.Tag < b.Tag
+	})
+	if len(trending) > limit {
+		trending = trending[:limit]
+	}
+	return trending
+}
+
+// TrendingHashtags ranks the tags used in the last q.Window.
+func (db *DB) TrendingHashtags(q TrendingQuery) ([]TrendingHashtag, error) {
+	q = q.normalize()
+	since := now().Add(-q.Window)
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	start := sort.Search(len(db.hashtagUses), func(i int) bool { return db.hashtagUses[i].at.After(since) })
+	counts := make(map[string]int)
+	lastUsed := make(map[string]time.Time)
+	for _, use := range db.hashtagUses[start:] {
+		counts[use.tag]++
+		lastUsed[use.tag] = use.at
+	}
+
+	return rankTrending(counts, lastUsed, q.Limit), nil
+}
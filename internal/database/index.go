@@ -0,0 +1,360 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// indexes are secondary lookups over DB.data. They are rebuilt from scratch
+// on open and kept up to date by save; nothing else may write to them.
+type indexes struct {
+	usersByEmail map[string]int
+	// usersByHandle holds the ids of the users sharing each handle in
+	// ascending order.
+	usersByHandle map[string][]int
+	// chirpIds holds every chirp id and chirpsByAuthor each author's chirp
+	// ids, both in ascending order.
+	chirpIds       []int
+	chirpsByAuthor map[int][]int
+	// chirpsByHashtag holds each tag's chirp ids in ascending order and
+	// hashtagUses every timestamped use ordered by time.
+	chirpsByHashtag map[string][]int
+	hashtagUses     []hashtagUse
+	chirpsByMention map[int][]int
+	// chirpsByParent holds the ids of the live and tombstoned replies to
+	// each chirp in ascending order.
+	chirpsByParent map[int][]int
+	// rechirpsOf holds the ids of each chirp's rechirps in ascending order.
+	rechirpsOf map[int][]int
+	search     searchIndex
+	// followers is the reverse of DBStructure.Follows.
+	followers map[int][]int
+	// sessionsByHash finds a session by its token hash and rotatedHashes
+	// by the hash of a token it has rotated out. sessionsByUser holds each
+	// user's session ids in ascending order.
+	sessionsByHash map[string]int
+	rotatedHashes  map[string]int
+	sessionsByUser map[int][]int
+}
+
+func (db *DB) buildIndexes() {
+	db.indexes = indexes{
+		usersByEmail:    make(map[string]int, len(db.data.Users)),
+		usersByHandle:   make(map[string][]int),
+		chirpsByAuthor:  make(map[int][]int),
+		chirpsByHashtag: make(map[string][]int),
+		chirpsByMention: make(map[int][]int),
+		chirpsByParent:  make(map[int][]int),
+		rechirpsOf:      make(map[int][]int),
+		followers:       make(map[int][]int),
+		search:          newSearchIndex(),
+		sessionsByHash:  make(map[string]int, len(db.data.Sessions)),
+		rotatedHashes:   make(map[string]int),
+		sessionsByUser:  make(map[int][]int),
+	}
+
+	for _, user := range db.data.Users {
+		db.indexUser(user)
+	}
+
+	chirpIds := make([]int, 0, len(db.data.Chirps))
+	for id := range db.data.Chirps {
+		chirpIds = append(chirpIds, id)
+	}
+	sort.Ints(chirpIds)
+	for _, id := range chirpIds {
+		db.indexChirp(db.data.Chirps[id])
+	}
+	for id := range db.data.Tombstones {
+		db.indexTombstone(id)
+	}
+	for followerId, followeeIds := range db.data.Follows {
+		for _, followeeId := range followeeIds {
+			db.followers[followeeId] = insertId(db.followers[followeeId], followerId)
+		}
+	}
+	for _, session := range db.data.Sessions {
+		db.indexSession(session)
+	}
+}
+
+// save persists entry, then applies it to the in-memory state and keeps the
+// indexes in step. If entry can't be persisted nothing changes, so readers
+// never see a write that isn't on disk. The caller must hold mux for
+// writing.
+func (db *DB) save(entry walEntry) error {
+	err := entry.check(&db.data)
+	if err != nil {
+		return err
+	}
+
+	next, applied, err := db.persist(entry)
+	if err != nil {
+		return err
+	}
+
+	db.unindex(entry)
+	if applied {
+		db.data = next
+	} else {
+		// check has passed, so this can't fail.
+		entry.apply(&db.data)
+	}
+	db.index(entry)
+
+	db.finishSave()
+	return nil
+}
+
+// unindex drops index entries for the records entry is about to replace or
+// delete.
+func (db *DB) unindex(entry walEntry) {
+	switch entry.Op {
+	case opPutChirp, opEditChirp:
+		if old, ok := db.data.Chirps[entry.Chirp.Id]; ok {
+			db.unindexChirp(old)
+		}
+	case opDeleteChirp:
+		for _, id := range append([]int{entry.Id}, entry.Rechirps...) {
+			if old, ok := db.data.Chirps[id]; ok {
+				db.unindexChirp(old)
+			}
+		}
+	case opPutUser:
+		if old, ok := db.data.Users[entry.User.Id]; ok {
+			db.unindexUser(old)
+		}
+	case opUnfollow:
+		removeFromIndex(db.followers, entry.Follow.FolloweeId, entry.Follow.FollowerId)
+	case opPutSession:
+		if old, ok := db.data.Sessions[entry.Session.Id]; ok {
+			db.unindexSession(old)
+		}
+	case opDeleteSession:
+		if old, ok := db.data.Sessions[entry.Id]; ok {
+			db.unindexSession(old)
+		}
+	case opPurgeSessions:
+		for _, id := range entry.Ids {
+			if old, ok := db.data.Sessions[id]; ok {
+				db.unindexSession(old)
+			}
+		}
+	case opRevokeTokens:
+		if old, ok := db.data.Users[entry.User.Id]; ok {
+			db.unindexUser(old)
+		}
+		for _, id := range entry.Ids {
+			if old, ok := db.data.Sessions[id]; ok {
+				db.unindexSession(old)
+			}
+		}
+	}
+}
+
+func (db *DB) index(entry walEntry) {
+	switch entry.Op {
+	case opPutChirp, opEditChirp:
+		db.indexChirp(*entry.Chirp)
+	case opDeleteChirp:
+		if entry.Tombstone {
+			db.indexTombstone(entry.Id)
+		}
+	case opPutUser, opRevokeTokens:
+		db.indexUser(*entry.User)
+	case opFollow:
+		db.followers[entry.Follow.FolloweeId] = insertId(db.followers[entry.Follow.FolloweeId], entry.Follow.FollowerId)
+	case opPutSession:
+		db.indexSession(*entry.Session)
+	}
+}
+
+func (db *DB) indexUser(user User) {
+	db.usersByEmail[user.Email] = user.Id
+	handle := UserHandle(user.Email)
+	db.usersByHandle[handle] = insertId(db.usersByHandle[handle], user.Id)
+}
+
+func (db *DB) unindexUser(user User) {
+	delete(db.usersByEmail, user.Email)
+	handle := UserHandle(user.Email)
+	removeFromIndex(db.usersByHandle, handle, user.Id)
+}
+
+func (db *DB) indexSession(session Session) {
+	db.sessionsByHash[session.TokenHash] = session.Id
+	for _, hash := range session.Rotated {
+		db.rotatedHashes[hash] = session.Id
+	}
+	db.sessionsByUser[session.UserId] = insertId(db.sessionsByUser[session.UserId], session.Id)
+}
+
+func (db *DB) unindexSession(session Session) {
+	delete(db.sessionsByHash, session.TokenHash)
+	for _, hash := range session.Rotated {
+		delete(db.rotatedHashes, hash)
+	}
+	removeFromIndex(db.sessionsByUser, session.UserId, session.Id)
+}
+
+func (db *DB) indexChirp(chirp Chirp) {
+	db.search.add(chirp)
+	db.indexHashtags(chirp)
+	for _, userId := range chirp.Mentions {
+		db.chirpsByMention[userId] = insertId(db.chirpsByMention[userId], chirp.Id)
+	}
+	if chirp.InReplyTo != 0 {
+		db.chirpsByParent[chirp.InReplyTo] = insertId(db.chirpsByParent[chirp.InReplyTo], chirp.Id)
+	}
+	if chirp.RechirpOf != 0 {
+		db.rechirpsOf[chirp.RechirpOf] = insertId(db.rechirpsOf[chirp.RechirpOf], chirp.Id)
+	}
+	db.chirpIds = insertId(db.chirpIds, chirp.Id)
+	db.chirpsByAuthor[chirp.AuthorId] = insertId(db.chirpsByAuthor[chirp.AuthorId], chirp.Id)
+}
+
+func (db *DB) unindexChirp(chirp Chirp) {
+	db.search.remove(chirp)
+	db.unindexHashtags(chirp)
+	for _, userId := range chirp.Mentions {
+		removeFromIndex(db.chirpsByMention, userId, chirp.Id)
+	}
+	if chirp.InReplyTo != 0 {
+		removeFromIndex(db.chirpsByParent, chirp.InReplyTo, chirp.Id)
+	}
+	if chirp.RechirpOf != 0 {
+		removeFromIndex(db.rechirpsOf, chirp.RechirpOf, chirp.Id)
+	}
+	db.chirpIds = removeId(db.chirpIds, chirp.Id)
+	removeFromIndex(db.chirpsByAuthor, chirp.AuthorId, chirp.Id)
+}
+
+func (db *DB) indexTombstone(id int) {
+	if parent := db.data.Tombstones[id]; parent != 0 {
+		db.chirpsByParent[parent] = insertId(db.chirpsByParent[parent], id)
+	}
+}
+
+// chirpSourcesFor returns the ascending, disjoint id lists whose union is
+// the chirps matching every filter of q. A timeline is one list per
+// followed author, merged by pageIds.
+func (db *DB) chirpSourcesFor(q ChirpQuery) [][]int {
+	sources := db.filterSources(q)
+	if q.Since.IsZero() && q.Until.IsZero() {
+		return sources
+	}
+
+	// Creation times follow ids, so a time range is an id range.
+	from, to := 0, db.data.Sequences.Chirps+1
+	if !q.Since.IsZero() {
+		from = db.firstChirpCreatedFrom(q.Since)
+	}
+	if !q.Until.IsZero() {
+		to = db.firstChirpCreatedFrom(q.Until)
+	}
+	for i, ids := range sources {
+		lo := sort.SearchInts(ids, from)
+		hi := max(lo, sort.SearchInts(ids, to))
+		sources[i] = ids[lo:hi]
+	}
+	return sources
+}
+
+// firstChirpCreatedFrom returns the lowest id a chirp created at or after t
+// has or will have.
+func (db *DB) firstChirpCreatedFrom(t time.Time) int {
+	i := sort.Search(len(db.chirpIds), func(i int) bool {
+		createdAt := db.data.Chirps[db.chirpIds[i]].CreatedAt
+		return createdAt != nil && !createdAt.Before(t)
+	})
+	if i == len(db.chirpIds) {
+		return db.data.Sequences.Chirps + 1
+	}
+	return db.chirpIds[i]
+}
+
+// filterSources is chirpSourcesFor without the time range.
+func (db *DB) filterSources(q ChirpQuery) [][]int {
+	filters := [][]int{}
+	if q.AuthorId != 0 {
+		filters = append(filters, db.chirpsByAuthor[q.AuthorId])
+	}
+	if q.Hashtag != "" {
+		filters = append(filters, db.chirpsByHashtag[q.Hashtag])
+	}
+	if q.MentionId != 0 {
+		filters = append(filters, db.chirpsByMention[q.MentionId])
+	}
+
+	if q.TimelineOf != 0 {
+		sources := [][]int{}
+		for _, followeeId := range db.data.Follows[q.TimelineOf] {
+			ids := db.chirpsByAuthor[followeeId]
+			for _, filter := range filters {
+				ids = intersectIds(ids, filter)
+			}
+			sources = append(sources, ids)
+		}
+		return sources
+	}
+
+	if len(filters) == 0 {
+		return [][]int{db.chirpIds}
+	}
+	ids := filters[0]
+	for _, filter := range filters[1:] {
+		ids = intersectIds(ids, filter)
+	}
+	return [][]int{ids}
+}
+
+// insertId adds id to the sorted slice ids. New chirp ids are always the
+// largest, so for chirp indexes this is an append in practice.
+func insertId(ids []int, id int) []int {
+	i := sort.SearchInts(ids, id)
+	if i < len(ids) && ids[i] == id {
+		return ids
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
+
+// removeId deletes id from the sorted slice ids.
+func removeId(ids []int, id int) []int {
+	i := sort.SearchInts(ids, id)
+	if i == len(ids) || ids[i] != id {
+		return ids
+	}
+	return append(ids[:i], ids[i+1:]...)
+}
+
+// removeFromIndex deletes id from the sorted slice stored under key,
+// dropping the key once nothing is left.
+func removeFromIndex[K comparable](index map[K][]int, key K, id int) {
+	ids := removeId(index[key], id)
+	if len(ids) == 0 {
+		delete(index, key)
+		return
+	}
+	index[key] = ids
+}
+
+// intersectIds returns the ids present in both sorted slices.
+func intersectIds(a []int, b []int) []int {
+	ids := []int{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			ids = append(ids, a[i])
+			i++
+			j++
+		}
+	}
+	return ids
+}
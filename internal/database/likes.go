@@ -0,0 +1,63 @@
+package database
+
+import (
+	"sort"
+)
+
+// Like records that UserId likes ChirpId.
+type Like struct {
+	ChirpId int `json:"chirp_id"`
+	UserId  int `json:"user_id"`
+}
+
+// LikeChirp makes userId like chirpId. Liking a chirp twice is not an error.
+func (db *DB) LikeChirp(chirpId int, userId int) error {
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, ok := db.data.Chirps[chirpId]; !ok {
+		return ErrorChirpDoesNotExist
+	}
+	if _, ok := db.data.Users[userId]; !ok {
+		return ErrorUserNotFound
+	}
+
+	err := db.save(walEntry{Op: opLike, Like: &Like{ChirpId: chirpId, UserId: userId}})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnlikeChirp undoes LikeChirp. Unliking a chirp not liked is not an error.
+func (db *DB) UnlikeChirp(chirpId int, userId int) error {
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, ok := db.data.Chirps[chirpId]; !ok {
+		return ErrorChirpDoesNotExist
+	}
+
+	err := db.save(walEntry{Op: opUnlike, Like: &Like{ChirpId: chirpId, UserId: userId}})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// LikedChirps reports which of chirpIds userId likes.
+func (db *DB) LikedChirps(userId int, chirpIds []int) (map[int]bool, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	liked := make(map[int]bool)
+	for _, chirpId := range chirpIds {
+		likes := db.data.Likes[chirpId]
+		if i := sort.SearchInts(likes, userId); i < len(likes) && likes[i] == userId {
+			liked[chirpId] = true
+		}
+	}
+	return liked, nil
+}
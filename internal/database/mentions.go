@@ -0,0 +1,49 @@
+package database
+
+import (
+	"regexp"
+	"strings"
+)
+
+// mentionPattern matches an @ that starts a word, so an email address quoted
+// in a chirp is not a mention.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_.@+-])@([A-Za-z0-9._+-]+)`)
+
+// UserHandle is the name a user is mentioned by: the part of their email
+// before the @, lowercased.
+func UserHandle(email string) string {
+	handle, _, _ := strings.Cut(email, "@")
+	return strings.ToLower(handle)
+}
+
+// ExtractMentions returns the distinct handles mentioned in body in the order
+// they first appear.
+func ExtractMentions(body string) []string {
+	handles := []string{}
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		// A mention at the end of a sentence takes the full stop with it.
+		handle := strings.ToLower(strings.TrimRight(match[1], "."))
+		if handle == "" || seen[handle] {
+			continue
+		}
+		seen[handle] = true
+		handles = append(handles, handle)
+	}
+	return handles
+}
+
+// resolveMentions maps each handle to the one user it belongs to. Handles
+// shared by several users, or by none, are dropped.
+func resolveMentions(handles []string, lookup func(handle string) []int) []int {
+	mentions := []int{}
+	for _, handle := range handles {
+		if ids := lookup(handle); len(ids) == 1 {
+			mentions = append(mentions, ids[0])
+		}
+	}
+	if len(mentions) == 0 {
+		return nil
+	}
+	return mentions
+}
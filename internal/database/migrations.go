@@ -0,0 +1,427 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// document is a database file decoded without a schema, so migrations can
+// reshape data that no longer fits DBStructure.
+type document map[string]any
+
+type migration struct {
+	description string
+	// migrate upgrades doc by one version in place and returns a short
+	// summary of what it changed.
+	migrate func(doc document) (string, error)
+}
+
+// migrations upgrade the JSON file from version i to i+1. Files written
+// before schema_version existed are version 0. Never edit or reorder a
+// released entry; append a new one.
+var migrations = []migration{
+	{
+		description: "add per-collection id sequences",
+		migrate:     migrateAddSequences,
+	},
+	{
+		description: "extract hashtags from chirp bodies",
+		migrate:     migrateExtractHashtags,
+	},
+	{
+		description: "resolve @mentions in chirp bodies",
+		migrate:     migrateResolveMentions,
+	},
+	{
+		// Only adds optional fields, in_reply_to on chirps and tombstones.
+		description: "add reply threads",
+		migrate:     func(doc document) (string, error) { return "", nil },
+	},
+	{
+		// Only adds the optional follows collection.
+		description: "add follows",
+		migrate:     func(doc document) (string, error) { return "", nil },
+	},
+	{
+		// Only adds the optional likes collection.
+		description: "add likes",
+		migrate:     func(doc document) (string, error) { return "", nil },
+	},
+	{
+		// Only adds the optional rechirp_of and quote_of fields.
+		description: "add rechirps and quotes",
+		migrate:     func(doc document) (string, error) { return "", nil },
+	},
+	{
+		// Only adds the optional revisions collection.
+		description: "add chirp revisions",
+		migrate:     func(doc document) (string, error) { return "", nil },
+	},
+	{
+		// Only adds the optional created_at and updated_at fields. When
+		// existing records were created is not known, so they stay unset.
+		description: "add created and updated times",
+		migrate:     func(doc document) (string, error) { return "", nil },
+	},
+	{
+		// Only adds the optional flags collection.
+		description: "add moderation flags",
+		migrate:     func(doc document) (string, error) { return "", nil },
+	},
+	{
+		description: "move refresh tokens to sessions",
+		migrate:     migrateRefreshTokensToSessions,
+	},
+	{
+		// Only adds the optional rotated field on sessions.
+		description: "add refresh token rotation",
+		migrate:     func(doc document) (string, error) { return "", nil },
+	},
+	{
+		// Only adds the optional token_key field. Rekeying needs
+		// Options.TokenKey, so NewDB does it rather than a migration.
+		description: "record how refresh tokens are hashed",
+		migrate:     func(doc document) (string, error) { return "", nil },
+	},
+	{
+		// Only adds the optional token_version field on users.
+		description: "add token versions",
+		migrate:     func(doc document) (string, error) { return "", nil },
+	},
+}
+
+var currentSchemaVersion = len(migrations)
+
+// MigrationStep describes one migration that was, or in a dry run would be,
+// applied.
+type MigrationStep struct {
+	Version     int
+	Description string
+	Changes     string
+}
+
+func (s MigrationStep) String() string {
+	if s.Changes == "" {
+		return fmt.Sprintf("%d: %s", s.Version, s.Description)
+	}
+	return fmt.Sprintf("%d: %s (%s)", s.Version, s.Description, s.Changes)
+}
+
+// migrateDocument runs every pending migration over content and returns the
+// upgraded file along with the steps it took.
+func migrateDocument(content []byte) ([]byte, []MigrationStep, error) {
+	doc := document{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	version, err := doc.int("schema_version")
+	if err != nil {
+		return nil, nil, err
+	}
+	if version > currentSchemaVersion {
+		return nil, nil, fmt.Errorf("schema version %d is newer than this binary supports (%d)", version, currentSchemaVersion)
+	}
+	if version == currentSchemaVersion {
+		return content, nil, nil
+	}
+
+	steps := []MigrationStep{}
+	for i := version; i < currentSchemaVersion; i++ {
+		changes, err := migrations[i].migrate(doc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		steps = append(steps, MigrationStep{Version: i + 1, Description: migrations[i].description, Changes: changes})
+	}
+	doc["schema_version"] = currentSchemaVersion
+
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return migrated, steps, nil
+}
+
+// Migrate brings the store at path up to the current schema. With dryRun set
+// it only reports what would be applied and leaves the file untouched.
+func Migrate(driver string, path string, dryRun bool) ([]MigrationStep, error) {
+	switch driver {
+	case "", "json":
+		return migrateJSONFile(path, dryRun)
+	case "sqlite":
+		return migrateSQLiteFile(path, dryRun)
+	}
+	return nil, fmt.Errorf("unknown database driver %q", driver)
+}
+
+func migrateJSONFile(path string, dryRun bool) ([]MigrationStep, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) || len(content) == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, steps, err := migrateDocument(content)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrorCorruptFile, path, err)
+	}
+
+	if dryRun || len(steps) == 0 {
+		return steps, nil
+	}
+
+	db, err := NewDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		return nil, err
+	}
+	return steps, db.Close()
+}
+
+func (doc document) int(key string) (int, error) {
+	v, ok := doc[key]
+	if !ok || v == nil {
+		return 0, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("%s is not a number", key)
+	}
+	i, err := strconv.Atoi(n.String())
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return i, nil
+}
+
+// object returns the JSON object stored under key, creating it if missing.
+func (doc document) object(key string) (document, error) {
+	v, ok := doc[key]
+	if !ok || v == nil {
+		obj := document{}
+		doc[key] = obj
+		return obj, nil
+	}
+	switch obj := v.(type) {
+	case map[string]any:
+		return document(obj), nil
+	case document:
+		return obj, nil
+	}
+	return nil, fmt.Errorf("%s is not an object", key)
+}
+
+// maxKey returns the largest integer key of the object under key.
+func (doc document) maxKey(key string) (int, error) {
+	obj, err := doc.object(key)
+	if err != nil {
+		return 0, err
+	}
+	highest := 0
+	for k := range obj {
+		id, err := strconv.Atoi(k)
+		if err != nil {
+			return 0, fmt.Errorf("%s has non-numeric key %q", key, k)
+		}
+		highest = max(highest, id)
+	}
+	return highest, nil
+}
+
+// migrateAddSequences starts each id sequence at the highest id in use, so
+// ids freed by deletes are never handed out again.
+func migrateAddSequences(doc document) (string, error) {
+	sequences, err := doc.object("sequences")
+	if err != nil {
+		return "", err
+	}
+
+	changes := []string{}
+	for _, collection := range []string{"chirps", "users"} {
+		highest, err := doc.maxKey(collection)
+		if err != nil {
+			return "", err
+		}
+		current, err := sequences.int(collection)
+		if err != nil {
+			return "", err
+		}
+		if highest > current {
+			sequences[collection] = highest
+			changes = append(changes, fmt.Sprintf("sequences.%s=%d", collection, highest))
+		}
+	}
+	sort.Strings(changes)
+	return strings.Join(changes, ", "), nil
+}
+
+// migrateExtractHashtags tags existing chirps. When they were written is
+// unknown, so the tags carry no used_at and never count towards trending.
+func migrateExtractHashtags(doc document) (string, error) {
+	chirps, err := doc.object("chirps")
+	if err != nil {
+		return "", err
+	}
+
+	tagged := 0
+	for id := range chirps {
+		chirp, err := chirps.object(id)
+		if err != nil {
+			return "", err
+		}
+		body, ok := chirp["body"].(string)
+		if !ok {
+			return "", fmt.Errorf("chirp %s has no body", id)
+		}
+
+		hashtags := []any{}
+		for _, tag := range ExtractHashtags(body) {
+			hashtags = append(hashtags, map[string]any{"tag": tag})
+		}
+		if len(hashtags) > 0 {
+			chirp["hashtags"] = hashtags
+			tagged++
+		}
+	}
+
+	if tagged == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("tagged %d chirps", tagged), nil
+}
+
+// migrateResolveMentions resolves mentions against the users in the file,
+// with the same rules CreateChirp applies.
+func migrateResolveMentions(doc document) (string, error) {
+	users, err := doc.object("users")
+	if err != nil {
+		return "", err
+	}
+	chirps, err := doc.object("chirps")
+	if err != nil {
+		return "", err
+	}
+
+	handles := make(map[string][]int)
+	for key := range users {
+		user, err := users.object(key)
+		if err != nil {
+			return "", err
+		}
+		id, err := user.int("id")
+		if err != nil {
+			return "", err
+		}
+		email, ok := user["email"].(string)
+		if !ok {
+			return "", fmt.Errorf("user %s has no email", key)
+		}
+		handle := UserHandle(email)
+		handles[handle] = append(handles[handle], id)
+	}
+	lookup := func(handle string) []int { return handles[handle] }
+
+	resolved := 0
+	for id := range chirps {
+		chirp, err := chirps.object(id)
+		if err != nil {
+			return "", err
+		}
+		body, ok := chirp["body"].(string)
+		if !ok {
+			return "", fmt.Errorf("chirp %s has no body", id)
+		}
+
+		mentions := resolveMentions(ExtractMentions(body), lookup)
+		if len(mentions) > 0 {
+			chirp["mentions"] = mentions
+			resolved++
+		}
+	}
+
+	if resolved == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("resolved mentions in %d chirps", resolved), nil
+}
+
+// migratedSessionLifetime is what login gives a refresh token. When a
+// migrated token was issued is unknown, so it is treated as issued by the
+// migration.
+const migratedSessionLifetime = 60 * 24 * time.Hour
+
+// migrateRefreshTokensToSessions turns the single refresh token each user
+// held into a session of their own, keeping only its hash.
+func migrateRefreshTokensToSessions(doc document) (string, error) {
+	users, err := doc.object("users")
+	if err != nil {
+		return "", err
+	}
+	sessions, err := doc.object("sessions")
+	if err != nil {
+		return "", err
+	}
+	sequences, err := doc.object("sequences")
+	if err != nil {
+		return "", err
+	}
+	lastId, err := sequences.int("sessions")
+	if err != nil {
+		return "", err
+	}
+
+	// Number the sessions in user order so the result doesn't depend on
+	// map iteration.
+	type token struct {
+		userId int
+		token  string
+	}
+	tokens := []token{}
+	for key := range users {
+		user, err := users.object(key)
+		if err != nil {
+			return "", err
+		}
+		refreshToken, _ := user["refresh_token"].(string)
+		delete(user, "refresh_token")
+		if refreshToken == "" {
+			continue
+		}
+		userId, err := user.int("id")
+		if err != nil {
+			return "", err
+		}
+		tokens = append(tokens, token{userId: userId, token: refreshToken})
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].userId < tokens[j].userId })
+
+	issuedAt := now().UTC()
+	for _, t := range tokens {
+		lastId++
+		sessions[strconv.Itoa(lastId)] = Session{
+			Id:         lastId,
+			UserId:     t.userId,
+			TokenHash:  hashRefreshToken(t.token),
+			CreatedAt:  issuedAt,
+			LastUsedAt: issuedAt,
+			ExpiresAt:  issuedAt.Add(migratedSessionLifetime),
+		}
+	}
+	if len(tokens) == 0 {
+		return "", nil
+	}
+	sequences["sessions"] = lastId
+	return fmt.Sprintf("moved %d refresh tokens", len(tokens)), nil
+}
@@ -0,0 +1,232 @@
+package database
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrorInvalidCursor = errors.New("Invalid cursor")
+
+const (
+	DefaultChirpLimit = 50
+	MaxChirpLimit     = 100
+)
+
+type SortOrder string
+
+const (
+	SortAsc  SortOrder = "asc"
+	SortDesc SortOrder = "desc"
+	// SortLikes puts the most liked chirps first and breaks ties newest
+	// first.
+	SortLikes SortOrder = "likes"
+	// SortCreatedAt puts the oldest chirps first. Creation times follow
+	// ids, so this is the order of SortAsc.
+	SortCreatedAt SortOrder = "created_at"
+)
+
+// ChirpQuery selects one page of chirps. The zero value asks for the first
+// DefaultChirpLimit chirps of every author in ascending id order.
+type ChirpQuery struct {
+	// AuthorId restricts the page to one author when non-zero.
+	AuthorId int
+	// Hashtag restricts the page to chirps using the tag when non-empty.
+	Hashtag string
+	// MentionId restricts the page to chirps mentioning the user when
+	// non-zero.
+	MentionId int
+	// TimelineOf restricts the page to chirps by the accounts the user
+	// follows when non-zero.
+	TimelineOf int
+	// Since and Until, when set, restrict the page to chirps created at or
+	// after Since and before Until. Chirps created before creation times
+	// were recorded count as older than any time.
+	Since time.Time
+	Until time.Time
+	Sort  SortOrder
+	Limit int
+	// Cursor is the NextCursor of the previous page, or empty for the first.
+	Cursor string
+}
+
+type ChirpPage struct {
+	Chirps []Chirp
+	// NextCursor fetches the page after this one. It is empty on the last
+	// page.
+	NextCursor string
+}
+
+// cursor is the decoded form of ChirpQuery.Cursor. It records the sort it
+// was issued for, so it cannot be replayed against a different ordering.
+type cursor struct {
+	Sort SortOrder `json:"s"`
+	Id   int       `json:"id"`
+	// Likes is the like count chirp Id had when the cursor was issued, for
+	// SortLikes. Counts move between requests, so a chirp liked or unliked
+	// meanwhile can be skipped or repeated.
+	Likes int `json:"l,omitempty"`
+}
+
+func (q ChirpQuery) normalize() (ChirpQuery, cursor, error) {
+	if q.Sort == "" {
+		q.Sort = SortAsc
+	}
+	switch q.Sort {
+	case SortAsc, SortDesc, SortLikes, SortCreatedAt:
+	default:
+		return q, cursor{}, errors.New("Unknown sort order")
+	}
+
+	if q.Limit <= 0 {
+		q.Limit = DefaultChirpLimit
+	}
+	q.Limit = min(q.Limit, MaxChirpLimit)
+
+	if q.Hashtag != "" {
+		hashtag, err := NormalizeHashtag(q.Hashtag)
+		if err != nil {
+			return q, cursor{}, err
+		}
+		q.Hashtag = hashtag
+	}
+
+	c, err := decodeCursor(q.Cursor, q.Sort)
+	return q, c, err
+}
+
+// decodeCursor parses s, which must have been issued for sort. An empty s
+// is the start of the first page.
+func decodeCursor(s string, sort SortOrder) (cursor, error) {
+	c := cursor{Sort: sort}
+	if s == "" {
+		return c, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, ErrorInvalidCursor
+	}
+	err = json.Unmarshal(data, &c)
+	if err != nil || c.Sort != sort || c.Id <= 0 {
+		return cursor{}, ErrorInvalidCursor
+	}
+	return c, nil
+}
+
+func (c cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// pageIds picks the page after c out of the union of sources, each of
+// which must be sorted ascending and disjoint from the others. It walks the
+// sources with a k-way merge, so the cost depends on the page size rather
+// than on how many ids there are. It returns the page and the cursor for
+// the next one.
+func pageIds(sources [][]int, limit int, c cursor) ([]int, string) {
+	desc := c.Sort == SortDesc
+	h := &idHeap{desc: desc}
+	for _, ids := range sources {
+		var i int
+		switch {
+		case desc && c.Id > 0:
+			i = sort.SearchInts(ids, c.Id) - 1
+		case desc:
+			i = len(ids) - 1
+		case c.Id > 0:
+			i = sort.SearchInts(ids, c.Id+1)
+		}
+		if i >= 0 && i < len(ids) {
+			h.sources = append(h.sources, idSource{ids: ids, i: i})
+		}
+	}
+	heap.Init(h)
+
+	page := []int{}
+	for h.Len() > 0 && len(page) < limit {
+		src := &h.sources[0]
+		page = append(page, src.ids[src.i])
+		if desc {
+			src.i--
+		} else {
+			src.i++
+		}
+		if src.i < 0 || src.i >= len(src.ids) {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+
+	if len(page) == limit && h.Len() > 0 {
+		return page, cursor{Sort: c.Sort, Id: page[len(page)-1]}.encode()
+	}
+	return page, ""
+}
+
+// pageByLikes picks the page after c out of the union of sources in
+// SortLikes order, looking up each chirp's count with likes. Counts are not
+// indexed, so unlike pageIds it ranks every id the sources hold.
+func pageByLikes(sources [][]int, likes func(id int) int, limit int, c cursor) ([]int, string) {
+	ranked := []cursor{}
+	for _, ids := range sources {
+		for _, id := range ids {
+			ranked = append(ranked, cursor{Sort: c.Sort, Id: id, Likes: likes(id)})
+		}
+	}
+	before := func(a, b cursor) bool {
+		if a.Likes != b.Likes {
+			return a.Likes > b.Likes
+		}
+		return a.Id > b.Id
+	}
+	sort.Slice(ranked, func(i, j int) bool { return before(ranked[i], ranked[j]) })
+
+	start := 0
+	if c.Id > 0 {
+		start = sort.Search(len(ranked), func(i int) bool { return before(c, ranked[i]) })
+	}
+	end := min(start+limit, len(ranked))
+
+	page := []int{}
+	for _, r := range ranked[start:end] {
+		page = append(page, r.Id)
+	}
+	if end > start && end < len(ranked) {
+		return page, ranked[end-1].encode()
+	}
+	return page, ""
+}
+
+// idSource is a sorted id slice and the position pageIds reads next.
+type idSource struct {
+	ids []int
+	i   int
+}
+
+// idHeap orders sources by their next id, smallest first or, with desc,
+// largest first.
+type idHeap struct {
+	sources []idSource
+	desc    bool
+}
+
+func (h idHeap) Len() int { return len(h.sources) }
+func (h idHeap) Less(i, j int) bool {
+	a, b := h.sources[i], h.sources[j]
+	if h.desc {
+		return a.ids[a.i] > b.ids[b.i]
+	}
+	return a.ids[a.i] < b.ids[b.i]
+}
+func (h idHeap) Swap(i, j int) { h.sources[i], h.sources[j] = h.sources[j], h.sources[i] }
+func (h *idHeap) Push(x any)   { h.sources = append(h.sources, x.(idSource)) }
+func (h *idHeap) Pop() any {
+	last := h.sources[len(h.sources)-1]
+	h.sources = h.sources[:len(h.sources)-1]
+	return last
+}
@@ -0,0 +1,68 @@
+package database
+
+import "errors"
+
+var (
+	ErrorSharedChirpDoesNotExist = errors.New("Chirp being shared doesn't exist")
+	ErrorAlreadyRechirped        = errors.New("Chirp was already rechirped")
+)
+
+// SharedId is the id of the chirp a rechirp or quote points at, or 0.
+func (c Chirp) SharedId() int {
+	if c.RechirpOf != 0 {
+		return c.RechirpOf
+	}
+	return c.QuoteOf
+}
+
+// resolveRechirp returns the chirp id stands for when it is replied to,
+// quoted or rechirped: a rechirp stands for its original. The caller must
+// hold mux.
+func (db *DB) resolveRechirp(id int) (Chirp, bool) {
+	chirp, ok := db.data.Chirps[id]
+	if ok && chirp.RechirpOf != 0 {
+		chirp, ok = db.data.Chirps[chirp.RechirpOf]
+	}
+	return chirp, ok
+}
+
+// CreateRechirp shares chirpId on authorId's behalf. Each user can rechirp a
+// chirp once.
+func (db *DB) CreateRechirp(authorId int, chirpId int) (Chirp, error) {
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	original, ok := db.resolveRechirp(chirpId)
+	if !ok {
+		return Chirp{}, ErrorSharedChirpDoesNotExist
+	}
+	for _, id := range db.rechirpsOf[original.Id] {
+		if db.data.Chirps[id].AuthorId == authorId {
+			return Chirp{}, ErrorAlreadyRechirped
+		}
+	}
+
+	chirp, err := db.createChirp(Chirp{AuthorId: authorId, RechirpOf: original.Id})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return db.view(chirp), nil
+}
+
+func (db *DB) CreateQuote(body string, authorId int, quoteOf int) (Chirp, error) {
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	original, ok := db.resolveRechirp(quoteOf)
+	if !ok {
+		return Chirp{}, ErrorSharedChirpDoesNotExist
+	}
+
+	chirp, err := db.createChirp(Chirp{Body: body, AuthorId: authorId, QuoteOf: original.Id})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return db.view(chirp), nil
+}
@@ -0,0 +1,84 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrorCannotEditRechirp = errors.New("Rechirps can't be edited")
+
+// Revision is a body a chirp had before it was edited.
+type Revision struct {
+	Body string `json:"body"`
+	// ReplacedAt is when an edit replaced Body.
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// editHashtags tags the new body of an edited chirp. Tags the chirp already
+// had keep their original use time, so editing a chirp does not make its
+// tags trend again.
+func editHashtags(old []Hashtag, body string, editedAt time.Time) []Hashtag {
+	usedAt := make(map[string]*time.Time, len(old))
+	for _, hashtag := range old {
+		usedAt[hashtag.Tag] = hashtag.UsedAt
+	}
+
+	hashtags := newHashtags(body, editedAt)
+	for i, hashtag := range hashtags {
+		if old, ok := usedAt[hashtag.Tag]; ok {
+			hashtags[i].UsedAt = old
+		}
+	}
+	return hashtags
+}
+
+// UpdateChirp replaces the body of one of authorId's chirps, keeping the old
+// body as a revision. Setting the body it already has changes nothing.
+func (db *DB) UpdateChirp(id int, authorId int, body string) (Chirp, error) {
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	chirp, ok := db.data.Chirps[id]
+	if !ok {
+		return Chirp{}, ErrorChirpDoesNotExist
+	}
+	if chirp.AuthorId != authorId {
+		return Chirp{}, ErrorNotChirpAuthor
+	}
+	if chirp.RechirpOf != 0 {
+		return Chirp{}, ErrorCannotEditRechirp
+	}
+	if chirp.Body == body {
+		return db.view(chirp), nil
+	}
+
+	editedAt := now().UTC()
+	revision := Revision{Body: chirp.Body, ReplacedAt: editedAt}
+	chirp.Body = body
+	chirp.UpdatedAt = &editedAt
+	chirp.Hashtags = editHashtags(chirp.Hashtags, body, editedAt)
+	chirp.Mentions = resolveMentions(ExtractMentions(body), func(handle string) []int {
+		return db.usersByHandle[handle]
+	})
+
+	index := len(db.data.Revisions[id])
+	err := db.save(walEntry{Op: opEditChirp, Chirp: &chirp, Revision: &revision, RevisionIndex: &index})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return db.view(chirp), nil
+}
+
+// GetRevisions returns the earlier bodies of a chirp, oldest first.
+func (db *DB) GetRevisions(id int) ([]Revision, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	if _, ok := db.data.Chirps[id]; !ok {
+		return nil, ErrorChirpDoesNotExist
+	}
+
+	return append([]Revision{}, db.data.Revisions[id]...), nil
+}
@@ -0,0 +1,246 @@
+package database
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var ErrorEmptySearch = errors.New("Search query is empty")
+
+// SearchQuery is a full-text search over chirp bodies. Query is a list of
+// clauses that must all match: a bare word, a word ending in * to match any
+// word with that prefix, or a "quoted phrase" whose words must appear next
+// to each other in order.
+type SearchQuery struct {
+	Query    string
+	AuthorId int
+	Limit    int
+}
+
+// searchClause is one parsed clause of a SearchQuery. A phrase has more than
+// one token; a prefix clause has exactly one.
+type searchClause struct {
+	tokens []string
+	prefix bool
+}
+
+// tokenize splits text into lowercase words of letters and digits, the unit
+// both the inverted index and queries work in.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func parseSearchQuery(query string) ([]searchClause, error) {
+	clauses := []searchClause{}
+
+	for i, part := range strings.Split(query, `"`) {
+		// Odd parts sit between a pair of quotes.
+		if i%2 == 1 {
+			tokens := tokenize(part)
+			if len(tokens) > 0 {
+				clauses = append(clauses, searchClause{tokens: tokens})
+			}
+			continue
+		}
+
+		for _, word := range strings.Fields(part) {
+			// Only the last token of a word like "e-mail*" is a prefix.
+			tokens := tokenize(word)
+			for j, token := range tokens {
+				prefix := j == len(tokens)-1 && strings.HasSuffix(word, "*")
+				clauses = append(clauses, searchClause{tokens: []string{token}, prefix: prefix})
+			}
+		}
+	}
+
+	if len(clauses) == 0 {
+		return nil, ErrorEmptySearch
+	}
+	return clauses, nil
+}
+
+func (q SearchQuery) normalize() (SearchQuery, []searchClause, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultChirpLimit
+	}
+	q.Limit = min(q.Limit, MaxChirpLimit)
+
+	clauses, err := parseSearchQuery(q.Query)
+	return q, clauses, err
+}
+
+// searchIndex is an inverted index from token to the chirps containing it,
+// with the positions it occurs at for phrase matching.
+type searchIndex struct {
+	postings map[string]map[int][]int
+	// terms holds the keys of postings in sorted order for prefix lookups.
+	terms []string
+}
+
+func newSearchIndex() searchIndex {
+	return searchIndex{postings: make(map[string]map[int][]int)}
+}
+
+func (s *searchIndex) add(chirp Chirp) {
+	for pos, token := range tokenize(chirp.Body) {
+		docs, ok := s.postings[token]
+		if !ok {
+			docs = make(map[int][]int)
+			s.postings[token] = docs
+			i := sort.SearchStrings(s.terms, token)
+			s.terms = append(s.terms, "")
+			copy(s.terms[i+1:], s.terms[i:])
+			s.terms[i] = token
+		}
+		docs[chirp.Id] = append(docs[chirp.Id], pos)
+	}
+}
+
+func (s *searchIndex) remove(chirp Chirp) {
+	for _, token := range tokenize(chirp.Body) {
+		docs, ok := s.postings[token]
+		if !ok {
+			continue
+		}
+		delete(docs, chirp.Id)
+		if len(docs) == 0 {
+			delete(s.postings, token)
+			i := sort.SearchStrings(s.terms, token)
+			if i < len(s.terms) && s.terms[i] == token {
+				s.terms = append(s.terms[:i], s.terms[i+1:]...)
+			}
+		}
+	}
+}
+
+// expand returns the indexed terms a clause token stands for.
+func (s *searchIndex) expand(token string, prefix bool) []string {
+	if !prefix {
+		return []string{token}
+	}
+	terms := []string{}
+	for i := sort.SearchStrings(s.terms, token); i < len(s.terms) && strings.HasPrefix(s.terms[i], token); i++ {
+		terms = append(terms, s.terms[i])
+	}
+	return terms
+}
+
+// match scores every chirp that satisfies all clauses with tf-idf summed
+// over the clauses. total is the number of indexed chirps.
+func (s *searchIndex) match(clauses []searchClause, total int) map[int]float64 {
+	var scores map[int]float64
+
+	for _, clause := range clauses {
+		clauseScores := s.matchClause(clause, total)
+		if scores == nil {
+			scores = clauseScores
+			continue
+		}
+		for id := range scores {
+			score, ok := clauseScores[id]
+			if !ok {
+				delete(scores, id)
+				continue
+			}
+			scores[id] += score
+		}
+	}
+
+	return scores
+}
+
+func (s *searchIndex) matchClause(clause searchClause, total int) map[int]float64 {
+	scores := make(map[int]float64)
+	idf := func(term string) float64 {
+		return math.Log(1 + float64(total)/float64(len(s.postings[term])))
+	}
+
+	if len(clause.tokens) == 1 {
+		for _, term := range s.expand(clause.tokens[0], clause.prefix) {
+			weight := idf(term)
+			for id, positions := range s.postings[term] {
+				scores[id] += float64(len(positions)) * weight
+			}
+		}
+		return scores
+	}
+
+	// A phrase matches where each token sits one position after the last.
+	first := clause.tokens[0]
+	for id, starts := range s.postings[first] {
+		count := 0
+		for _, start := range starts {
+			if s.phraseAt(clause.tokens[1:], id, start+1) {
+				count++
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		for _, token := range clause.tokens {
+			scores[id] += float64(count) * idf(token)
+		}
+	}
+	return scores
+}
+
+func (s *searchIndex) phraseAt(tokens []string, id int, pos int) bool {
+	for i, token := range tokens {
+		positions := s.postings[token][id]
+		j := sort.SearchInts(positions, pos+i)
+		if j == len(positions) || positions[j] != pos+i {
+			return false
+		}
+	}
+	return true
+}
+
+// rankIds orders scored chirp ids by descending score, newest first among
+// equal scores.
+func rankIds(scores map[int]float64) []int {
+	ids := make([]int, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] > ids[j]
+	})
+	return ids
+}
+
+// SearchChirps returns the chirps matching q, most relevant first.
+func (db *DB) SearchChirps(q SearchQuery) ([]Chirp, error) {
+	q, clauses, err := q.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	scores := db.search.match(clauses, len(db.data.Chirps))
+	if q.AuthorId != 0 {
+		for id := range scores {
+			if db.data.Chirps[id].AuthorId != q.AuthorId {
+				delete(scores, id)
+			}
+		}
+	}
+
+	chirps := []Chirp{}
+	for _, id := range rankIds(scores) {
+		if len(chirps) == q.Limit {
+			break
+		}
+		chirps = append(chirps, db.view(db.data.Chirps[id]))
+	}
+	return chirps, nil
+}
@@ -0,0 +1,366 @@
+package database
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// maxRotatedTokens is how many of a session's earlier refresh tokens are
+// remembered for reuse detection. Refreshed hourly, that is over a day's
+// worth.
+const maxRotatedTokens = 32
+
+var ErrorInvalidRefreshToken = errors.New("Unable to Validate Refresh Token")
+var ErrorRefreshTokenExpired = errors.New("Refresh token has expired")
+var ErrorRefreshTokenReused = errors.New("Refresh token was already used")
+var ErrorSessionNotFound = errors.New("Session not found")
+var ErrorTokenKeyMismatch = errors.New("Refresh token key doesn't match the one the store is keyed with")
+
+// Device describes what a session was started from. Both fields are
+// whatever the client sent and are only shown back to the user.
+type Device struct {
+	Label     string `json:"device,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// Session is one signed-in device, holding the refresh token it was given.
+// Only a hash of the token is stored.
+//
+// Refreshing rotates the token, so a session is a family of tokens of which
+// only the latest is valid. Rotated holds the hashes of the earlier ones:
+// one of them being presented means the family has leaked, and the session
+// is revoked. Only the last maxRotatedTokens are kept; one older than that
+// is simply invalid. SQLiteDB keeps them in a table of their own and leaves
+// Rotated empty.
+type Session struct {
+	Id        int      `json:"id"`
+	UserId    int      `json:"user_id"`
+	TokenHash string   `json:"token_hash"`
+	Rotated   []string `json:"rotated,omitempty"`
+	Device
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// hashRefreshToken is the plain SHA-256 of refreshToken, which stores hold
+// until they are opened with Options.TokenKey.
+func hashRefreshToken(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenKeyFingerprint identifies key without revealing it. A store keeps
+// the fingerprint of the key its hashes are keyed under, or none while they
+// are plain.
+func tokenKeyFingerprint(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("chirpy refresh token key"))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// checkTokenKey reports whether a store whose hashes are keyed under the
+// key with fingerprint stored, or plain if it is empty, has to be rekeyed to
+// be opened with key. A different key gives ErrorTokenKeyMismatch rather
+// than letting every session silently stop matching. Without a key a store
+// still opens, for maintenance, but can't look up keyed tokens.
+func checkTokenKey(stored string, key []byte) (rekey bool, err error) {
+	switch {
+	case len(key) == 0:
+		return false, nil
+	case stored == "":
+		return true, nil
+	case stored != tokenKeyFingerprint(key):
+		return false, ErrorTokenKeyMismatch
+	}
+	return false, nil
+}
+
+// tokenHasher turns refresh tokens into the hash they are stored and looked
+// up by. A keyed hash is the HMAC-SHA256 of the plain hash rather than of
+// the token, so a store of plain hashes can be rekeyed without the tokens.
+//
+// Sessions are looked up by the presented token's hash directly. Without the
+// key a caller can't compute the hash of any token it tries, so how long a
+// lookup takes tells it nothing about the stored hashes, and no
+// constant-time comparison is needed.
+type tokenHasher struct {
+	key   []byte
+	keyed bool
+}
+
+func (h tokenHasher) hash(refreshToken string) string {
+	hash := hashRefreshToken(refreshToken)
+	if !h.keyed {
+		return hash
+	}
+	keyed, _ := h.rekey(hash)
+	return keyed
+}
+
+// rekey returns the keyed hash for the token plain is the SHA-256 of.
+func (h tokenHasher) rekey(plain string) (string, error) {
+	sum, err := hex.DecodeString(plain)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write(sum)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// tokens hashes refresh tokens the way the store holds them.
+func (db *DB) tokens() tokenHasher {
+	return tokenHasher{key: db.opts.TokenKey, keyed: db.data.TokenKey != ""}
+}
+
+// keyTokenHashes rekeys every stored token hash under key.
+func (d *DBStructure) keyTokenHashes(key []byte) error {
+	h := tokenHasher{key: key, keyed: true}
+	for id, session := range d.Sessions {
+		hash, err := h.rekey(session.TokenHash)
+		if err != nil {
+			return fmt.Errorf("session %d: %w", id, err)
+		}
+		session.TokenHash = hash
+		rotated := make([]string, 0, len(session.Rotated))
+		for _, plain := range session.Rotated {
+			hash, err := h.rekey(plain)
+			if err != nil {
+				return fmt.Errorf("session %d: %w", id, err)
+			}
+			rotated = append(rotated, hash)
+		}
+		if len(rotated) > 0 {
+			session.Rotated = rotated
+		}
+		d.Sessions[id] = session
+	}
+	d.TokenKey = tokenKeyFingerprint(key)
+	return nil
+}
+
+// StoreRefreshToken starts a session for userId on device, valid for
+// expireIn. A user may have any number of sessions.
+func (db *DB) StoreRefreshToken(userId int, refreshToken string, expireIn time.Duration, device Device) (Session, error) {
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, ok := db.data.Users[userId]; !ok {
+		return Session{}, ErrorUserNotFound
+	}
+
+	createdAt := now().UTC()
+	session := Session{
+		Id:         db.data.Sequences.Sessions + 1,
+		UserId:     userId,
+		TokenHash:  db.tokens().hash(refreshToken),
+		Device:     device,
+		CreatedAt:  createdAt,
+		LastUsedAt: createdAt,
+		ExpiresAt:  createdAt.Add(expireIn),
+	}
+
+	err := db.save(walEntry{Op: opPutSession, Session: &session})
+	if err != nil {
+		return Session{}, err
+	}
+
+	return session, nil
+}
+
+// expired reports whether the session's refresh token has run out at t.
+func (s Session) expired(t time.Time) bool {
+	return !t.Before(s.ExpiresAt)
+}
+
+// useRefreshToken returns the unexpired session refreshToken is the latest
+// token of. A rotated token revokes its session and gives
+// ErrorRefreshTokenReused along with the revoked session. The caller must
+// hold mux for writing.
+func (db *DB) useRefreshToken(refreshToken string, usedAt time.Time) (Session, error) {
+	hash := db.tokens().hash(refreshToken)
+
+	if id, ok := db.rotatedHashes[hash]; ok {
+		session := db.data.Sessions[id]
+		err := db.save(walEntry{Op: opDeleteSession, Id: id})
+		if err != nil {
+			return Session{}, err
+		}
+		return session, ErrorRefreshTokenReused
+	}
+
+	id, ok := db.sessionsByHash[hash]
+	if !ok {
+		return Session{}, ErrorInvalidRefreshToken
+	}
+	session := db.data.Sessions[id]
+	if session.expired(usedAt) {
+		return Session{}, ErrorRefreshTokenExpired
+	}
+	return session, nil
+}
+
+// ValidateRefreshToken returns the session refreshToken belongs to and
+// records that it was used.
+func (db *DB) ValidateRefreshToken(refreshToken string) (Session, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	usedAt := now().UTC()
+	session, err := db.useRefreshToken(refreshToken, usedAt)
+	if err != nil {
+		return session, err
+	}
+	session.LastUsedAt = usedAt
+
+	err = db.save(walEntry{Op: opPutSession, Session: &session})
+	if err != nil {
+		return Session{}, err
+	}
+
+	return session, nil
+}
+
+// RotateRefreshToken replaces refreshToken, which must be the latest token
+// of its session, with newRefreshToken. The session keeps its expiry.
+func (db *DB) RotateRefreshToken(refreshToken string, newRefreshToken string) (Session, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	usedAt := now().UTC()
+	session, err := db.useRefreshToken(refreshToken, usedAt)
+	if err != nil {
+		return session, err
+	}
+	rotated := append(session.Rotated, session.TokenHash)
+	session.Rotated = slices.Clone(rotated[max(0, len(rotated)-maxRotatedTokens):])
+	session.TokenHash = db.tokens().hash(newRefreshToken)
+	session.LastUsedAt = usedAt
+
+	err = db.save(walEntry{Op: opPutSession, Session: &session})
+	if err != nil {
+		return Session{}, err
+	}
+
+	return session, nil
+}
+
+// RevokeRefreshToken ends the session refreshToken belongs to.
+func (db *DB) RevokeRefreshToken(refreshToken string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	id, ok := db.sessionsByHash[db.tokens().hash(refreshToken)]
+	if !ok {
+		return ErrorInvalidRefreshToken
+	}
+
+	err := db.save(walEntry{Op: opDeleteSession, Id: id})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetSessions returns userId's unexpired sessions, oldest first.
+func (db *DB) GetSessions(userId int) ([]Session, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	t := now()
+	sessions := []Session{}
+	for _, id := range db.sessionsByUser[userId] {
+		if session := db.data.Sessions[id]; !session.expired(t) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+// RevokeSession ends one of userId's sessions. Another user's session is
+// reported as not found.
+func (db *DB) RevokeSession(userId int, sessionId int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	session, ok := db.data.Sessions[sessionId]
+	if !ok || session.UserId != userId {
+		return ErrorSessionNotFound
+	}
+
+	err := db.save(walEntry{Op: opDeleteSession, Id: sessionId})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// revokeTokens bumps user's token version and returns the entry that saves
+// it along with ending all of user's sessions. The caller must hold mux for
+// writing.
+func (db *DB) revokeTokens(user *User) walEntry {
+	user.TokenVersion++
+	return walEntry{Op: opRevokeTokens, User: user, Ids: append([]int{}, db.sessionsByUser[user.Id]...)}
+}
+
+// RevokeAllTokens signs userId out everywhere.
+func (db *DB) RevokeAllTokens(userId int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	user, ok := db.data.Users[userId]
+	if !ok {
+		return ErrorUserNotFound
+	}
+
+	err := db.save(db.revokeTokens(&user))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// TokenVersion returns the token version userId's access tokens must carry.
+func (db *DB) TokenVersion(userId int) (int, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	user, ok := db.data.Users[userId]
+	if !ok {
+		return 0, ErrorUserNotFound
+	}
+	return user.TokenVersion, nil
+}
+
+// PurgeExpiredSessions deletes every session whose refresh token has run
+// out and returns how many there were.
+func (db *DB) PurgeExpiredSessions() (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	t := now()
+	expired := []int{}
+	for id, session := range db.data.Sessions {
+		if session.expired(t) {
+			expired = append(expired, id)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	sort.Ints(expired)
+
+	err := db.save(walEntry{Op: opPurgeSessions, Ids: expired})
+	if err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
@@ -0,0 +1,1757 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteDB is a Store backed by a SQLite database file on local disk.
+type SQLiteDB struct {
+	path   string
+	conn   *sql.DB
+	tokens tokenHasher
+}
+
+type sqliteMigration struct {
+	description string
+	sql         string
+	// migrate, if set, runs after sql in the same transaction for data
+	// changes SQL alone cannot express.
+	migrate func(tx *sql.Tx) error
+}
+
+// sqliteMigrations are applied in order on open. The schema version is kept
+// in PRAGMA user_version, so an entry must never be edited once released;
+// append a new one instead.
+var sqliteMigrations = []sqliteMigration{
+	{
+		description: "create users and chirps",
+		sql: `CREATE TABLE users (
+			id            INTEGER PRIMARY KEY AUTOINCREMENT,
+			email         TEXT    NOT NULL UNIQUE,
+			password      TEXT    NOT NULL,
+			is_chirpy_red INTEGER NOT NULL DEFAULT 0,
+			refresh_token TEXT
+		);
+		CREATE UNIQUE INDEX users_refresh_token ON users(refresh_token);
+
+		CREATE TABLE chirps (
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			body      TEXT    NOT NULL,
+			author_id INTEGER NOT NULL
+		);
+		CREATE INDEX chirps_author_id ON chirps(author_id, id);`,
+	},
+	{
+		description: "add full-text search over chirp bodies",
+		sql: `CREATE VIRTUAL TABLE chirps_fts USING fts5(body, content='chirps', content_rowid='id');
+
+		CREATE TRIGGER chirps_fts_insert AFTER INSERT ON chirps BEGIN
+			INSERT INTO chirps_fts(rowid, body) VALUES (new.id, new.body);
+		END;
+		CREATE TRIGGER chirps_fts_delete AFTER DELETE ON chirps BEGIN
+			INSERT INTO chirps_fts(chirps_fts, rowid, body) VALUES ('delete', old.id, old.body);
+		END;
+		CREATE TRIGGER chirps_fts_update AFTER UPDATE OF body ON chirps BEGIN
+			INSERT INTO chirps_fts(chirps_fts, rowid, body) VALUES ('delete', old.id, old.body);
+			INSERT INTO chirps_fts(rowid, body) VALUES (new.id, new.body);
+		END;
+
+		INSERT INTO chirps_fts(chirps_fts) VALUES ('rebuild');`,
+	},
+	{
+		description: "extract hashtags from chirp bodies",
+		sql: `CREATE TABLE chirp_hashtags (
+			chirp_id INTEGER NOT NULL REFERENCES chirps(id) ON DELETE CASCADE,
+			position INTEGER NOT NULL,
+			tag      TEXT    NOT NULL,
+			used_at  INTEGER,
+			PRIMARY KEY (chirp_id, position)
+		);
+		CREATE INDEX chirp_hashtags_tag ON chirp_hashtags(tag, chirp_id);
+		CREATE INDEX chirp_hashtags_used_at ON chirp_hashtags(used_at) WHERE used_at IS NOT NULL;`,
+		migrate: migrateSQLiteHashtags,
+	},
+	{
+		description: "resolve @mentions in chirp bodies",
+		sql: `CREATE TABLE chirp_mentions (
+			chirp_id INTEGER NOT NULL REFERENCES chirps(id) ON DELETE CASCADE,
+			position INTEGER NOT NULL,
+			user_id  INTEGER NOT NULL,
+			PRIMARY KEY (chirp_id, position)
+		);
+		CREATE INDEX chirp_mentions_user_id ON chirp_mentions(user_id, chirp_id);
+		CREATE INDEX users_handle ON users(lower(CASE WHEN instr(email, '@') > 0 THEN substr(email, 1, instr(email, '@') - 1) ELSE email END));`,
+		migrate: migrateSQLiteMentions,
+	},
+	{
+		description: "add reply threads",
+		sql: `ALTER TABLE chirps ADD COLUMN in_reply_to INTEGER;
+		CREATE INDEX chirps_in_reply_to ON chirps(in_reply_to, id) WHERE in_reply_to IS NOT NULL;
+
+		CREATE TABLE chirp_tombstones (
+			id          INTEGER PRIMARY KEY,
+			in_reply_to INTEGER
+		);
+		CREATE INDEX chirp_tombstones_in_reply_to ON chirp_tombstones(in_reply_to) WHERE in_reply_to IS NOT NULL;
+
+		CREATE TRIGGER chirps_tombstone BEFORE DELETE ON chirps
+		WHEN EXISTS (SELECT 1 FROM chirps WHERE in_reply_to = old.id)
+			OR EXISTS (SELECT 1 FROM chirp_tombstones WHERE in_reply_to = old.id)
+		BEGIN
+			INSERT INTO chirp_tombstones (id, in_reply_to) VALUES (old.id, old.in_reply_to);
+		END;`,
+	},
+	{
+		description: "add follows",
+		sql: `CREATE TABLE follows (
+			follower_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			followee_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			PRIMARY KEY (follower_id, followee_id),
+			CHECK (follower_id != followee_id)
+		) WITHOUT ROWID;
+		CREATE INDEX follows_followee_id ON follows(followee_id, follower_id);`,
+	},
+	{
+		description: "add likes",
+		sql: `CREATE TABLE chirp_likes (
+			chirp_id INTEGER NOT NULL REFERENCES chirps(id) ON DELETE CASCADE,
+			user_id  INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			PRIMARY KEY (chirp_id, user_id)
+		) WITHOUT ROWID;
+		CREATE INDEX chirp_likes_user_id ON chirp_likes(user_id, chirp_id);
+
+		ALTER TABLE chirps ADD COLUMN like_count INTEGER NOT NULL DEFAULT 0;
+		CREATE INDEX chirps_like_count ON chirps(like_count, id);
+
+		CREATE TRIGGER chirp_likes_insert AFTER INSERT ON chirp_likes BEGIN
+			UPDATE chirps SET like_count = like_count + 1 WHERE id = new.chirp_id;
+		END;
+		CREATE TRIGGER chirp_likes_delete AFTER DELETE ON chirp_likes BEGIN
+			UPDATE chirps SET like_count = like_count - 1 WHERE id = old.chirp_id;
+		END;`,
+	},
+	{
+		description: "add rechirps and quotes",
+		sql: `ALTER TABLE chirps ADD COLUMN rechirp_of INTEGER REFERENCES chirps(id) ON DELETE CASCADE;
+		ALTER TABLE chirps ADD COLUMN quote_of INTEGER;
+		CREATE UNIQUE INDEX chirps_rechirp_of ON chirps(rechirp_of, author_id) WHERE rechirp_of IS NOT NULL;`,
+	},
+	{
+		description: "add chirp revisions",
+		sql: `CREATE TABLE chirp_revisions (
+			chirp_id    INTEGER NOT NULL REFERENCES chirps(id) ON DELETE CASCADE,
+			number      INTEGER NOT NULL,
+			body        TEXT    NOT NULL,
+			replaced_at INTEGER NOT NULL,
+			PRIMARY KEY (chirp_id, number)
+		) WITHOUT ROWID;`,
+	},
+	{
+		description: "add created and updated times",
+		sql: `ALTER TABLE chirps ADD COLUMN created_at INTEGER;
+		ALTER TABLE chirps ADD COLUMN updated_at INTEGER;
+		CREATE INDEX chirps_created_at ON chirps(created_at);
+
+		ALTER TABLE users ADD COLUMN created_at INTEGER;
+		ALTER TABLE users ADD COLUMN updated_at INTEGER;`,
+	},
+	{
+		description: "add moderation flags",
+		sql: `CREATE TABLE chirp_flags (
+			chirp_id   INTEGER PRIMARY KEY REFERENCES chirps(id) ON DELETE CASCADE,
+			rules      TEXT    NOT NULL,
+			flagged_at INTEGER NOT NULL
+		);`,
+	},
+	{
+		description: "move refresh tokens to sessions",
+		sql: `CREATE TABLE sessions (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			token_hash   TEXT    NOT NULL UNIQUE,
+			device       TEXT    NOT NULL DEFAULT '',
+			user_agent   TEXT    NOT NULL DEFAULT '',
+			created_at   INTEGER NOT NULL,
+			last_used_at INTEGER NOT NULL,
+			expires_at   INTEGER NOT NULL
+		);
+		CREATE INDEX sessions_user_id ON sessions(user_id, id);`,
+		migrate: migrateSQLiteRefreshTokens,
+	},
+	{
+		description: "index session expiry",
+		sql:         `CREATE INDEX sessions_expires_at ON sessions(expires_at);`,
+	},
+	{
+		description: "add refresh token rotation",
+		sql: `CREATE TABLE session_rotated_tokens (
+			token_hash TEXT    PRIMARY KEY,
+			session_id INTEGER NOT NULL REFERENCES sessions(id) ON DELETE CASCADE
+		) WITHOUT ROWID;
+		CREATE INDEX session_rotated_tokens_session_id ON session_rotated_tokens(session_id);`,
+	},
+	{
+		description: "record how refresh tokens are hashed",
+		sql: `CREATE TABLE settings (
+			name  TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		) WITHOUT ROWID;`,
+	},
+	{
+		description: "add token versions",
+		sql:         `ALTER TABLE users ADD COLUMN token_version INTEGER NOT NULL DEFAULT 0;`,
+	},
+	{
+		description: "order rotated refresh tokens",
+		sql:         `ALTER TABLE session_rotated_tokens ADD COLUMN generation INTEGER NOT NULL DEFAULT 0;`,
+	},
+}
+
+// sqliteUserHandle is UserHandle in SQL. It must stay identical to the
+// expression the users_handle index was created with, or lookups stop using
+// the index.
+const sqliteUserHandle = "lower(CASE WHEN instr(email, '@') > 0 THEN substr(email, 1, instr(email, '@') - 1) ELSE email END)"
+
+// migrateSQLiteHashtags tags existing chirps with a NULL used_at, as the JSON
+// migration does, so they never count towards trending.
+func migrateSQLiteHashtags(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, body FROM chirps")
+	if err != nil {
+		return err
+	}
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp := Chirp{}
+		err := rows.Scan(&chirp.Id, &chirp.Body)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		for _, tag := range ExtractHashtags(chirp.Body) {
+			chirp.Hashtags = append(chirp.Hashtags, Hashtag{Tag: tag})
+		}
+		chirps = append(chirps, chirp)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, chirp := range chirps {
+		err := insertHashtags(tx, chirp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateSQLiteMentions(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, body FROM chirps")
+	if err != nil {
+		return err
+	}
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp := Chirp{}
+		err := rows.Scan(&chirp.Id, &chirp.Body)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		chirps = append(chirps, chirp)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, chirp := range chirps {
+		chirp.Mentions, err = resolveSQLiteMentions(tx, chirp.Body)
+		if err == nil {
+			err = insertMentions(tx, chirp)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSQLiteRefreshTokens moves each user's refresh token into a session
+// as the JSON migration does, then drops the column.
+func migrateSQLiteRefreshTokens(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, refresh_token FROM users WHERE refresh_token IS NOT NULL AND refresh_token != '' ORDER BY id")
+	if err != nil {
+		return err
+	}
+	sessions := []Session{}
+	for rows.Next() {
+		session := Session{}
+		var refreshToken string
+		err := rows.Scan(&session.UserId, &refreshToken)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		session.TokenHash = hashRefreshToken(refreshToken)
+		sessions = append(sessions, session)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	issuedAt := now().UTC()
+	for _, session := range sessions {
+		_, err := tx.Exec(
+			"INSERT INTO sessions (user_id, token_hash, created_at, last_used_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+			session.UserId, session.TokenHash, issuedAt.UnixNano(), issuedAt.UnixNano(), issuedAt.Add(migratedSessionLifetime).UnixNano(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`DROP INDEX users_refresh_token;
+		ALTER TABLE users DROP COLUMN refresh_token;`)
+	return err
+}
+
+func NewSQLiteDB(path string, opts Options) (*SQLiteDB, error) {
+	if opts.Mode == ModeDev {
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			err := os.Remove(path + suffix)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+	}
+
+	// Transactions take the write lock when they begin. Every transaction
+	// here writes, most after reading, and a deferred one fails at once
+	// when it can't upgrade its lock, without waiting out busy_timeout.
+	dsn := path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_txlock=immediate"
+	conn, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &SQLiteDB{path: path, conn: conn}
+	err = db.migrate()
+	if err == nil {
+		err = db.loadTokenHashing(opts.TokenKey)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func (db *SQLiteDB) Close() error {
+	return db.conn.Close()
+}
+
+func (db *SQLiteDB) schemaVersion() (int, error) {
+	var version int
+	err := db.conn.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %v", ErrorCorruptFile, db.path, err)
+	}
+
+	if version > len(sqliteMigrations) {
+		return 0, fmt.Errorf("%s has schema version %d, newer than this binary supports (%d)", db.path, version, len(sqliteMigrations))
+	}
+	return version, nil
+}
+
+func (db *SQLiteDB) migrate() error {
+	version, err := db.schemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(sqliteMigrations[i].sql)
+		if err == nil && sqliteMigrations[i].migrate != nil {
+			err = sqliteMigrations[i].migrate(tx)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// loadTokenHashing sets db.tokens to match how the stored token hashes were
+// made, rekeying plain hashes under key first if need be.
+func (db *SQLiteDB) loadTokenHashing(key []byte) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	fingerprint := ""
+	err = tx.QueryRow("SELECT value FROM settings WHERE name = 'token_key'").Scan(&fingerprint)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	rekey, err := checkTokenKey(fingerprint, key)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, db.path)
+	}
+	if rekey {
+		h := tokenHasher{key: key, keyed: true}
+		for _, table := range []string{"sessions", "session_rotated_tokens"} {
+			err := rekeySQLiteTokenHashes(tx, h, table)
+			if err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrorCorruptFile, db.path, err)
+			}
+		}
+		fingerprint = tokenKeyFingerprint(key)
+		_, err = tx.Exec("INSERT INTO settings (name, value) VALUES ('token_key', ?)", fingerprint)
+		if err != nil {
+			return err
+		}
+	}
+
+	db.tokens = tokenHasher{key: key, keyed: fingerprint != ""}
+	return tx.Commit()
+}
+
+// rekeySQLiteTokenHashes replaces the plain hashes in table's token_hash
+// column with keyed ones.
+func rekeySQLiteTokenHashes(tx *sql.Tx, h tokenHasher, table string) error {
+	rows, err := tx.Query("SELECT token_hash FROM " + table)
+	if err != nil {
+		return err
+	}
+	hashes := []string{}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		keyed, err := h.rekey(hash)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE "+table+" SET token_hash = ? WHERE token_hash = ?", keyed, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateSQLiteFile(path string, dryRun bool) ([]MigrationStep, error) {
+	version := 0
+	if _, err := os.Stat(path); err == nil {
+		conn, err := sql.Open("sqlite", path+"?mode=ro")
+		if err != nil {
+			return nil, err
+		}
+		version, err = (&SQLiteDB{path: path, conn: conn}).schemaVersion()
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	steps := []MigrationStep{}
+	for i := version; i < len(sqliteMigrations); i++ {
+		steps = append(steps, MigrationStep{Version: i + 1, Description: sqliteMigrations[i].description})
+	}
+
+	if dryRun || len(steps) == 0 {
+		return steps, nil
+	}
+
+	db, err := NewSQLiteDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		return nil, err
+	}
+	return steps, db.Close()
+}
+
+func (db *SQLiteDB) CreateChirp(body string, authorId int) (Chirp, error) {
+	return db.createChirp(Chirp{Body: body, AuthorId: authorId})
+}
+
+func (db *SQLiteDB) CreateReply(body string, authorId int, inReplyTo int) (Chirp, error) {
+	return db.createChirp(Chirp{Body: body, AuthorId: authorId, InReplyTo: inReplyTo})
+}
+
+func (db *SQLiteDB) CreateRechirp(authorId int, chirpId int) (Chirp, error) {
+	return db.createChirp(Chirp{AuthorId: authorId, RechirpOf: chirpId})
+}
+
+func (db *SQLiteDB) CreateQuote(body string, authorId int, quoteOf int) (Chirp, error) {
+	return db.createChirp(Chirp{Body: body, AuthorId: authorId, QuoteOf: quoteOf})
+}
+
+// resolveSQLiteRechirp is DB.resolveRechirp in SQL: it replaces *id, if
+// set, with the id of the chirp it stands for, or fails with missing.
+func resolveSQLiteRechirp(tx *sql.Tx, id *int, missing error) error {
+	if *id == 0 {
+		return nil
+	}
+	err := tx.QueryRow("SELECT COALESCE(rechirp_of, id) FROM chirps WHERE id = ?", *id).Scan(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return missing
+	}
+	return err
+}
+
+// sqliteNullId maps the 0 that Chirp uses for no chirp to NULL.
+func sqliteNullId(id int) *int {
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
+
+// createChirp inserts chirp along with what is derived from its body, in one
+// transaction.
+func (db *SQLiteDB) createChirp(chirp Chirp) (Chirp, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	err = resolveSQLiteRechirp(tx, &chirp.InReplyTo, ErrorParentChirpDoesNotExist)
+	if err == nil {
+		err = resolveSQLiteRechirp(tx, &chirp.RechirpOf, ErrorSharedChirpDoesNotExist)
+	}
+	if err == nil {
+		err = resolveSQLiteRechirp(tx, &chirp.QuoteOf, ErrorSharedChirpDoesNotExist)
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	// Keep creation times in id order, as the JSON store does.
+	createdAt := now().UTC()
+	var latest sql.NullInt64
+	err = tx.QueryRow("SELECT MAX(created_at) FROM chirps").Scan(&latest)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if latest := timeFromSQLite(latest); latest != nil && latest.After(createdAt) {
+		createdAt = *latest
+	}
+	chirp.CreatedAt = &createdAt
+	chirp.UpdatedAt = &createdAt
+
+	res, err := tx.Exec(
+		"INSERT INTO chirps (body, author_id, in_reply_to, rechirp_of, quote_of, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		chirp.Body, chirp.AuthorId, sqliteNullId(chirp.InReplyTo), sqliteNullId(chirp.RechirpOf), sqliteNullId(chirp.QuoteOf),
+		sqliteTime(&createdAt), sqliteTime(&createdAt),
+	)
+	if isUniqueViolation(err) {
+		return Chirp{}, ErrorAlreadyRechirped
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	chirp.Id = int(id)
+	chirp.Hashtags = newHashtags(chirp.Body, createdAt)
+	chirp.Mentions, err = resolveSQLiteMentions(tx, chirp.Body)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	err = insertHashtags(tx, chirp)
+	if err == nil {
+		err = insertMentions(tx, chirp)
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.SharedId() == 0 {
+		return chirp, nil
+	}
+	// Read it back to pick up the shared chirp.
+	return db.GetChirp(chirp.Id)
+}
+
+// resolveSQLiteMentions applies resolveMentions to body against the users
+// table.
+func resolveSQLiteMentions(tx *sql.Tx, body string) ([]int, error) {
+	var lookupErr error
+	mentions := resolveMentions(ExtractMentions(body), func(handle string) []int {
+		ids := []int{}
+		if lookupErr != nil {
+			return ids
+		}
+		rows, err := tx.Query("SELECT id FROM users WHERE "+sqliteUserHandle+" = ? LIMIT 2", handle)
+		if err != nil {
+			lookupErr = err
+			return ids
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			if lookupErr = rows.Scan(&id); lookupErr != nil {
+				return ids
+			}
+			ids = append(ids, id)
+		}
+		lookupErr = rows.Err()
+		return ids
+	})
+	return mentions, lookupErr
+}
+
+func insertMentions(tx *sql.Tx, chirp Chirp) error {
+	for i, userId := range chirp.Mentions {
+		_, err := tx.Exec(
+			"INSERT INTO chirp_mentions (chirp_id, position, user_id) VALUES (?, ?, ?)",
+			chirp.Id, i, userId,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteTime and timeFromSQLite convert between times and the unix
+// nanoseconds they are stored as, with nil for NULL.
+func sqliteTime(t *time.Time) *int64 {
+	if t == nil {
+		return nil
+	}
+	nanos := t.UnixNano()
+	return &nanos
+}
+
+func timeFromSQLite(nanos sql.NullInt64) *time.Time {
+	if !nanos.Valid {
+		return nil
+	}
+	t := time.Unix(0, nanos.Int64).UTC()
+	return &t
+}
+
+func insertHashtags(tx *sql.Tx, chirp Chirp) error {
+	for i, hashtag := range chirp.Hashtags {
+		_, err := tx.Exec(
+			"INSERT INTO chirp_hashtags (chirp_id, position, tag, used_at) VALUES (?, ?, ?, ?)",
+			chirp.Id, i, hashtag.Tag, sqliteTime(hashtag.UsedAt),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const sqliteChirpColumns = "chirps.id, chirps.body, chirps.author_id, COALESCE(chirps.in_reply_to, 0)," +
+	" chirps.like_count, COALESCE(chirps.rechirp_of, 0), COALESCE(chirps.quote_of, 0), chirps.created_at, chirps.updated_at"
+
+// queryChirps runs a query selecting sqliteChirpColumns and fills in the
+// hashtags, mentions and shared chirps of the chirps it returns.
+func (db *SQLiteDB) queryChirps(query string, args ...any) ([]Chirp, error) {
+	chirps, err := db.scanChirps(query, args...)
+	if err != nil || len(chirps) == 0 {
+		return chirps, err
+	}
+
+	sharedIds := []any{}
+	for _, chirp := range chirps {
+		if id := chirp.SharedId(); id != 0 {
+			sharedIds = append(sharedIds, id)
+		}
+	}
+	if len(sharedIds) == 0 {
+		return chirps, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(sharedIds)), ", ")
+	shared, err := db.scanChirps("SELECT "+sqliteChirpColumns+" FROM chirps WHERE id IN ("+placeholders+")", sharedIds...)
+	if err != nil {
+		return nil, err
+	}
+	byId := make(map[int]*Chirp, len(shared))
+	for i := range shared {
+		byId[shared[i].Id] = &shared[i]
+	}
+	for i := range chirps {
+		chirps[i].Shared = byId[chirps[i].SharedId()]
+	}
+	return chirps, nil
+}
+
+// scanChirps is queryChirps without the shared chirps.
+func (db *SQLiteDB) scanChirps(query string, args ...any) ([]Chirp, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	byId := make(map[int]int)
+	for rows.Next() {
+		chirp := Chirp{}
+		var createdAt, updatedAt sql.NullInt64
+		err := rows.Scan(&chirp.Id, &chirp.Body, &chirp.AuthorId, &chirp.InReplyTo, &chirp.LikeCount, &chirp.RechirpOf, &chirp.QuoteOf, &createdAt, &updatedAt)
+		if err != nil {
+			return nil, err
+		}
+		chirp.CreatedAt = timeFromSQLite(createdAt)
+		chirp.UpdatedAt = timeFromSQLite(updatedAt)
+		byId[chirp.Id] = len(chirps)
+		chirps = append(chirps, chirp)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if len(chirps) == 0 {
+		return chirps, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(chirps)), ", ")
+	ids := make([]any, 0, len(chirps))
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.Id)
+	}
+	tagRows, err := db.conn.Query(
+		"SELECT chirp_id, tag, used_at FROM chirp_hashtags WHERE chirp_id IN ("+placeholders+") ORDER BY chirp_id, position",
+		ids...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer tagRows.Close()
+
+	for tagRows.Next() {
+		var chirpId int
+		var usedAt sql.NullInt64
+		hashtag := Hashtag{}
+		err := tagRows.Scan(&chirpId, &hashtag.Tag, &usedAt)
+		if err != nil {
+			return nil, err
+		}
+		hashtag.UsedAt = timeFromSQLite(usedAt)
+		chirp := &chirps[byId[chirpId]]
+		chirp.Hashtags = append(chirp.Hashtags, hashtag)
+	}
+	if err := tagRows.Err(); err != nil {
+		return nil, err
+	}
+	tagRows.Close()
+
+	mentionRows, err := db.conn.Query(
+		"SELECT chirp_id, user_id FROM chirp_mentions WHERE chirp_id IN ("+placeholders+") ORDER BY chirp_id, position",
+		ids...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer mentionRows.Close()
+
+	for mentionRows.Next() {
+		var chirpId, userId int
+		err := mentionRows.Scan(&chirpId, &userId)
+		if err != nil {
+			return nil, err
+		}
+		chirp := &chirps[byId[chirpId]]
+		chirp.Mentions = append(chirp.Mentions, userId)
+	}
+	return chirps, mentionRows.Err()
+}
+
+func (db *SQLiteDB) GetChirps(q ChirpQuery) (ChirpPage, error) {
+	q, c, err := q.normalize()
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	where := []string{"1 = 1"}
+	args := []any{}
+	if q.AuthorId != 0 {
+		where = append(where, "author_id = ?")
+		args = append(args, q.AuthorId)
+	}
+	if q.Hashtag != "" {
+		where = append(where, "id IN (SELECT chirp_id FROM chirp_hashtags WHERE tag = ?)")
+		args = append(args, q.Hashtag)
+	}
+	if q.MentionId != 0 {
+		where = append(where, "id IN (SELECT chirp_id FROM chirp_mentions WHERE user_id = ?)")
+		args = append(args, q.MentionId)
+	}
+	if q.TimelineOf != 0 {
+		where = append(where, "author_id IN (SELECT followee_id FROM follows WHERE follower_id = ?)")
+		args = append(args, q.TimelineOf)
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "(created_at IS NULL OR created_at < ?)")
+		args = append(args, q.Until.UnixNano())
+	}
+
+	order := "id ASC"
+	switch q.Sort {
+	case SortDesc:
+		order = "id DESC"
+	case SortLikes:
+		order = "like_count DESC, id DESC"
+	}
+	if c.Id > 0 {
+		switch q.Sort {
+		case SortDesc:
+			where = append(where, "id < ?")
+			args = append(args, c.Id)
+		case SortLikes:
+			where = append(where, "(like_count, id) < (?, ?)")
+			args = append(args, c.Likes, c.Id)
+		default:
+			where = append(where, "id > ?")
+			args = append(args, c.Id)
+		}
+	}
+
+	// Fetch one extra row to learn whether there is a next page.
+	args = append(args, q.Limit+1)
+	chirps, err := db.queryChirps(
+		"SELECT "+sqliteChirpColumns+" FROM chirps WHERE "+strings.Join(where, " AND ")+
+			" ORDER BY "+order+" LIMIT ?",
+		args...,
+	)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	page := ChirpPage{Chirps: chirps}
+	if len(chirps) > q.Limit {
+		page.Chirps = chirps[:q.Limit]
+		last := page.Chirps[q.Limit-1]
+		page.NextCursor = cursor{Sort: q.Sort, Id: last.Id, Likes: last.LikeCount}.encode()
+	}
+	return page, nil
+}
+
+// ftsMatch renders parsed clauses as an FTS5 query. Tokens only ever hold
+// letters and digits, so quoting them needs no escaping.
+func ftsMatch(clauses []searchClause) string {
+	terms := []string{}
+	for _, clause := range clauses {
+		term := `"` + strings.Join(clause.tokens, " ") + `"`
+		if clause.prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " AND ")
+}
+
+func (db *SQLiteDB) SearchChirps(q SearchQuery) ([]Chirp, error) {
+	q, clauses, err := q.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	where := []string{"chirps_fts MATCH ?"}
+	args := []any{ftsMatch(clauses)}
+	if q.AuthorId != 0 {
+		where = append(where, "chirps.author_id = ?")
+		args = append(args, q.AuthorId)
+	}
+
+	args = append(args, q.Limit)
+	return db.queryChirps(
+		"SELECT "+sqliteChirpColumns+" FROM chirps_fts"+
+			" JOIN chirps ON chirps.id = chirps_fts.rowid WHERE "+strings.Join(where, " AND ")+
+			" ORDER BY bm25(chirps_fts), chirps.id DESC LIMIT ?",
+		args...,
+	)
+}
+
+func (db *SQLiteDB) TrendingHashtags(q TrendingQuery) ([]TrendingHashtag, error) {
+	q = q.normalize()
+	since := now().Add(-q.Window)
+
+	rows, err := db.conn.Query(
+		"SELECT tag, COUNT(*), MAX(used_at) FROM chirp_hashtags WHERE used_at > ?"+
+			" GROUP BY tag ORDER BY COUNT(*) DESC, MAX(used_at) DESC, tag LIMIT ?",
+		since.UnixNano(), q.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trending := []TrendingHashtag{}
+	for rows.Next() {
+		hashtag := TrendingHashtag{}
+		var lastUsed int64
+		err := rows.Scan(&hashtag.Tag, &hashtag.Count, &lastUsed)
+		if err != nil {
+			return nil, err
+		}
+		trending = append(trending, hashtag)
+	}
+	return trending, rows.Err()
+}
+
+func (db *SQLiteDB) GetChirp(id int) (Chirp, error) {
+	chirps, err := db.queryChirps("SELECT "+sqliteChirpColumns+" FROM chirps WHERE id = ?", id)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if len(chirps) == 0 {
+		return Chirp{}, ErrorChirpDoesNotExist
+	}
+
+	return chirps[0], nil
+}
+
+// GetThread walks up to the root of the conversation and collects the
+// replies under it with a recursive query over chirps and tombstones.
+func (db *SQLiteDB) GetThread(id int, depth int) (ThreadNode, error) {
+	depth = normalizeThreadDepth(depth)
+
+	if _, err := db.GetChirp(id); err != nil {
+		return ThreadNode{}, err
+	}
+
+	root := id
+	for {
+		var parent sql.NullInt64
+		err := db.conn.QueryRow(
+			"SELECT in_reply_to FROM chirps WHERE id = ?1 UNION ALL SELECT in_reply_to FROM chirp_tombstones WHERE id = ?1",
+			root,
+		).Scan(&parent)
+		if errors.Is(err, sql.ErrNoRows) || !parent.Valid {
+			break
+		}
+		if err != nil {
+			return ThreadNode{}, err
+		}
+		root = int(parent.Int64)
+	}
+
+	// Two levels past depth are fetched: one to count the replies of the
+	// deepest nodes and one to tell which of those are empty tombstones.
+	const replies = `WITH RECURSIVE replies(id, parent, depth) AS (
+		SELECT id, in_reply_to, 1 FROM chirps WHERE in_reply_to = ?1
+		UNION ALL SELECT id, in_reply_to, 1 FROM chirp_tombstones WHERE in_reply_to = ?1
+		UNION ALL SELECT chirps.id, chirps.in_reply_to, replies.depth + 1
+			FROM chirps JOIN replies ON chirps.in_reply_to = replies.id WHERE replies.depth < ?2
+		UNION ALL SELECT chirp_tombstones.id, chirp_tombstones.in_reply_to, replies.depth + 1
+			FROM chirp_tombstones JOIN replies ON chirp_tombstones.in_reply_to = replies.id WHERE replies.depth < ?2
+	)`
+
+	rows, err := db.conn.Query(replies+" SELECT id, parent FROM replies ORDER BY id", root, depth+2)
+	if err != nil {
+		return ThreadNode{}, err
+	}
+	defer rows.Close()
+
+	children := make(map[int][]int)
+	for rows.Next() {
+		var replyId, parent int
+		err := rows.Scan(&replyId, &parent)
+		if err != nil {
+			return ThreadNode{}, err
+		}
+		children[parent] = append(children[parent], replyId)
+	}
+	if err := rows.Err(); err != nil {
+		return ThreadNode{}, err
+	}
+	rows.Close()
+
+	chirps, err := db.queryChirps(
+		replies+" SELECT "+sqliteChirpColumns+" FROM chirps WHERE id = ?1 OR id IN (SELECT id FROM replies)",
+		root, depth+2,
+	)
+	if err != nil {
+		return ThreadNode{}, err
+	}
+	byId := make(map[int]Chirp, len(chirps))
+	for _, chirp := range chirps {
+		byId[chirp.Id] = chirp
+	}
+
+	source := threadSource{
+		chirp: func(id int) (Chirp, bool) {
+			chirp, ok := byId[id]
+			return chirp, ok
+		},
+		replies: func(id int) []int {
+			return children[id]
+		},
+	}
+	return source.buildThread(root, depth), nil
+}
+
+func (db *SQLiteDB) DeleteChirp(id, authorId int) error {
+	chirp, err := db.GetChirp(id)
+	if err != nil {
+		return err
+	}
+
+	if chirp.AuthorId != authorId {
+		return ErrorNotChirpAuthor
+	}
+
+	_, err = db.conn.Exec("DELETE FROM chirps WHERE id = ? AND author_id = ?", id, authorId)
+	return err
+}
+
+// UpdateChirp replaces the body and everything derived from it in one
+// transaction, keeping the old body in chirp_revisions.
+func (db *SQLiteDB) UpdateChirp(id int, authorId int, body string) (Chirp, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	chirp := Chirp{Id: id}
+	var rechirpOf sql.NullInt64
+	err = tx.QueryRow("SELECT body, author_id, rechirp_of FROM chirps WHERE id = ?", id).Scan(&chirp.Body, &chirp.AuthorId, &rechirpOf)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrorChirpDoesNotExist
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.AuthorId != authorId {
+		return Chirp{}, ErrorNotChirpAuthor
+	}
+	if rechirpOf.Valid {
+		return Chirp{}, ErrorCannotEditRechirp
+	}
+	if chirp.Body == body {
+		return db.GetChirp(id)
+	}
+
+	rows, err := tx.Query("SELECT tag, used_at FROM chirp_hashtags WHERE chirp_id = ? ORDER BY position", id)
+	if err != nil {
+		return Chirp{}, err
+	}
+	for rows.Next() {
+		var usedAt sql.NullInt64
+		hashtag := Hashtag{}
+		if err := rows.Scan(&hashtag.Tag, &usedAt); err != nil {
+			rows.Close()
+			return Chirp{}, err
+		}
+		hashtag.UsedAt = timeFromSQLite(usedAt)
+		chirp.Hashtags = append(chirp.Hashtags, hashtag)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Chirp{}, err
+	}
+
+	editedAt := now().UTC()
+	_, err = tx.Exec(
+		"INSERT INTO chirp_revisions (chirp_id, number, body, replaced_at)"+
+			" SELECT ?1, COALESCE(MAX(number), 0) + 1, ?2, ?3 FROM chirp_revisions WHERE chirp_id = ?1",
+		id, chirp.Body, editedAt.UnixNano(),
+	)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	chirp.Body = body
+	chirp.Hashtags = editHashtags(chirp.Hashtags, body, editedAt)
+	chirp.Mentions, err = resolveSQLiteMentions(tx, body)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	_, err = tx.Exec("UPDATE chirps SET body = ?, updated_at = ? WHERE id = ?", body, sqliteTime(&editedAt), id)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM chirp_hashtags WHERE chirp_id = ?", id)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM chirp_mentions WHERE chirp_id = ?", id)
+	}
+	if err == nil {
+		err = insertHashtags(tx, chirp)
+	}
+	if err == nil {
+		err = insertMentions(tx, chirp)
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Chirp{}, err
+	}
+	return db.GetChirp(id)
+}
+
+func (db *SQLiteDB) GetRevisions(id int) ([]Revision, error) {
+	exists, err := db.chirpExists(id)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrorChirpDoesNotExist
+	}
+
+	rows, err := db.conn.Query("SELECT body, replaced_at FROM chirp_revisions WHERE chirp_id = ? ORDER BY number", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+		revision := Revision{}
+		var replacedAt int64
+		err := rows.Scan(&revision.Body, &replacedAt)
+		if err != nil {
+			return nil, err
+		}
+		revision.ReplacedAt = time.Unix(0, replacedAt).UTC()
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
+}
+
+func (db *SQLiteDB) chirpExists(chirpId int) (bool, error) {
+	var exists bool
+	err := db.conn.QueryRow("SELECT EXISTS (SELECT 1 FROM chirps WHERE id = ?)", chirpId).Scan(&exists)
+	return exists, err
+}
+
+func (db *SQLiteDB) LikeChirp(chirpId int, userId int) error {
+	exists, err := db.chirpExists(chirpId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrorChirpDoesNotExist
+	}
+	exists, err = db.userExists(userId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrorUserNotFound
+	}
+
+	_, err = db.conn.Exec("INSERT OR IGNORE INTO chirp_likes (chirp_id, user_id) VALUES (?, ?)", chirpId, userId)
+	return err
+}
+
+func (db *SQLiteDB) UnlikeChirp(chirpId int, userId int) error {
+	exists, err := db.chirpExists(chirpId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrorChirpDoesNotExist
+	}
+
+	_, err = db.conn.Exec("DELETE FROM chirp_likes WHERE chirp_id = ? AND user_id = ?", chirpId, userId)
+	return err
+}
+
+func (db *SQLiteDB) LikedChirps(userId int, chirpIds []int) (map[int]bool, error) {
+	liked := make(map[int]bool)
+	if len(chirpIds) == 0 {
+		return liked, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(chirpIds)), ", ")
+	args := []any{userId}
+	for _, id := range chirpIds {
+		args = append(args, id)
+	}
+	rows, err := db.conn.Query(
+		"SELECT chirp_id FROM chirp_likes WHERE user_id = ? AND chirp_id IN ("+placeholders+")",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var chirpId int
+		err := rows.Scan(&chirpId)
+		if err != nil {
+			return nil, err
+		}
+		liked[chirpId] = true
+	}
+	return liked, rows.Err()
+}
+
+// FlagChirp keeps the rules as a JSON array; they are only ever read back
+// whole.
+func (db *SQLiteDB) FlagChirp(chirpId int, rules []string) error {
+	exists, err := db.chirpExists(chirpId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrorChirpDoesNotExist
+	}
+
+	if len(rules) == 0 {
+		_, err = db.conn.Exec("DELETE FROM chirp_flags WHERE chirp_id = ?", chirpId)
+		return err
+	}
+
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	_, err = db.conn.Exec(
+		"INSERT INTO chirp_flags (chirp_id, rules, flagged_at) VALUES (?, ?, ?)"+
+			" ON CONFLICT (chirp_id) DO UPDATE SET rules = excluded.rules, flagged_at = excluded.flagged_at",
+		chirpId, string(data), now().UTC().UnixNano(),
+	)
+	return err
+}
+
+func (db *SQLiteDB) GetFlags() ([]Flag, error) {
+	rows, err := db.conn.Query("SELECT chirp_id, rules, flagged_at FROM chirp_flags ORDER BY chirp_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := []Flag{}
+	for rows.Next() {
+		flag := Flag{}
+		var rules string
+		var flaggedAt int64
+		err := rows.Scan(&flag.ChirpId, &rules, &flaggedAt)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(rules), &flag.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("flag of chirp %d: %w", flag.ChirpId, err)
+		}
+		flag.FlaggedAt = time.Unix(0, flaggedAt).UTC()
+		flags = append(flags, flag)
+	}
+	return flags, rows.Err()
+}
+
+const sqliteUserColumns = "id, email, password, is_chirpy_red, created_at, updated_at, token_version"
+
+func scanUser(row interface{ Scan(...any) error }) (User, error) {
+	user := User{}
+	var createdAt, updatedAt sql.NullInt64
+	err := row.Scan(&user.Id, &user.Email, &user.Password, &user.IsChirpyRed, &createdAt, &updatedAt, &user.TokenVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrorUserNotFound
+	}
+	user.CreatedAt = timeFromSQLite(createdAt)
+	user.UpdatedAt = timeFromSQLite(updatedAt)
+	return user, err
+}
+
+func (db *SQLiteDB) GetUser(userId int) (User, error) {
+	return scanUser(db.conn.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE id = ?", userId))
+}
+
+func (db *SQLiteDB) CreateUser(email string, password string) (User, error) {
+	hashPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	createdAt := now().UTC()
+	res, err := db.conn.Exec(
+		"INSERT INTO users (email, password, created_at, updated_at) VALUES (?, ?, ?, ?)",
+		email, string(hashPassword), sqliteTime(&createdAt), sqliteTime(&createdAt),
+	)
+	if isUniqueViolation(err) {
+		return User{}, ErrorDuplicatedUser
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+
+	return User{Id: int(id), Email: email, Password: string(hashPassword), IsChirpyRed: false, CreatedAt: &createdAt, UpdatedAt: &createdAt}, nil
+}
+
+func (db *SQLiteDB) UpdateUser(userId int, newEmail string, newPassword string) (User, error) {
+	hashPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	old, err := db.GetUser(userId)
+	if errors.Is(err, ErrorUserNotFound) {
+		return User{}, errors.New("Unable to find user")
+	}
+	if err != nil {
+		return User{}, err
+	}
+	bump := 0
+	if bcrypt.CompareHashAndPassword([]byte(old.Password), []byte(newPassword)) != nil {
+		bump = 1
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	// A password that changed again since it was compared counts as
+	// changed too.
+	updatedAt := now().UTC()
+	var tokenVersion int
+	err = tx.QueryRow(
+		"UPDATE users SET email = ?, password = ?, updated_at = ?, token_version = token_version + CASE WHEN password = ? THEN ? ELSE 1 END WHERE id = ? RETURNING token_version",
+		newEmail, string(hashPassword), sqliteTime(&updatedAt), old.Password, bump, userId,
+	).Scan(&tokenVersion)
+	if isUniqueViolation(err) {
+		return User{}, ErrorDuplicatedUser
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("Unable to find user")
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	if tokenVersion != old.TokenVersion {
+		_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", userId)
+		if err != nil {
+			return User{}, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return User{}, err
+	}
+	return db.GetUser(userId)
+}
+
+func (db *SQLiteDB) UpgradeUser(userId int) (User, error) {
+	updatedAt := now().UTC()
+	res, err := db.conn.Exec("UPDATE users SET is_chirpy_red = 1, updated_at = ? WHERE id = ?", sqliteTime(&updatedAt), userId)
+	if err != nil {
+		return User{}, err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return User{}, errors.New("Unable to find user")
+	}
+
+	return db.GetUser(userId)
+}
+
+func (db *SQLiteDB) Login(email string, password string) (User, error) {
+	user, err := scanUser(db.conn.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE email = ?", email))
+	if err != nil {
+		return User{}, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+const sqliteSessionColumns = "id, user_id, token_hash, device, user_agent, created_at, last_used_at, expires_at"
+
+func scanSession(row interface{ Scan(...any) error }) (Session, error) {
+	session := Session{}
+	var createdAt, lastUsedAt, expiresAt int64
+	err := row.Scan(&session.Id, &session.UserId, &session.TokenHash, &session.Label, &session.UserAgent, &createdAt, &lastUsedAt, &expiresAt)
+	if err != nil {
+		return Session{}, err
+	}
+	session.CreatedAt = time.Unix(0, createdAt).UTC()
+	session.LastUsedAt = time.Unix(0, lastUsedAt).UTC()
+	session.ExpiresAt = time.Unix(0, expiresAt).UTC()
+	return session, nil
+}
+
+func (db *SQLiteDB) StoreRefreshToken(userId int, refreshToken string, expireIn time.Duration, device Device) (Session, error) {
+	exists, err := db.userExists(userId)
+	if err != nil {
+		return Session{}, err
+	}
+	if !exists {
+		return Session{}, ErrorUserNotFound
+	}
+
+	createdAt := now().UTC()
+	session := Session{
+		UserId:     userId,
+		TokenHash:  db.tokens.hash(refreshToken),
+		Device:     device,
+		CreatedAt:  createdAt,
+		LastUsedAt: createdAt,
+		ExpiresAt:  createdAt.Add(expireIn),
+	}
+	res, err := db.conn.Exec(
+		"INSERT INTO sessions (user_id, token_hash, device, user_agent, created_at, last_used_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		session.UserId, session.TokenHash, session.Label, session.UserAgent,
+		session.CreatedAt.UnixNano(), session.LastUsedAt.UnixNano(), session.ExpiresAt.UnixNano(),
+	)
+	if err != nil {
+		return Session{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Session{}, err
+	}
+	session.Id = int(id)
+	return session, nil
+}
+
+// useSQLiteRefreshToken is useRefreshToken for SQLite, run inside tx and
+// given the token's hash. On ErrorRefreshTokenReused the revoked session is
+// returned and tx must still be committed.
+func useSQLiteRefreshToken(tx *sql.Tx, hash string, usedAt time.Time) (Session, error) {
+	session, err := scanSession(tx.QueryRow(
+		"SELECT "+sqliteSessionColumns+" FROM sessions WHERE id = (SELECT session_id FROM session_rotated_tokens WHERE token_hash = ?)",
+		hash,
+	))
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM sessions WHERE id = ?", session.Id)
+		if err != nil {
+			return Session{}, err
+		}
+		return session, ErrorRefreshTokenReused
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Session{}, err
+	}
+
+	session, err = scanSession(tx.QueryRow("SELECT "+sqliteSessionColumns+" FROM sessions WHERE token_hash = ?", hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrorInvalidRefreshToken
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	if session.expired(usedAt) {
+		return Session{}, ErrorRefreshTokenExpired
+	}
+	return session, nil
+}
+
+func (db *SQLiteDB) ValidateRefreshToken(refreshToken string) (Session, error) {
+	return db.useRefreshToken(refreshToken, "")
+}
+
+func (db *SQLiteDB) RotateRefreshToken(refreshToken string, newRefreshToken string) (Session, error) {
+	return db.useRefreshToken(refreshToken, newRefreshToken)
+}
+
+// useRefreshToken validates refreshToken and records that it was used,
+// replacing it with newRefreshToken unless that is empty.
+func (db *SQLiteDB) useRefreshToken(refreshToken string, newRefreshToken string) (Session, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Session{}, err
+	}
+	defer tx.Rollback()
+
+	usedAt := now().UTC()
+	session, err := useSQLiteRefreshToken(tx, db.tokens.hash(refreshToken), usedAt)
+	if errors.Is(err, ErrorRefreshTokenReused) {
+		if err := tx.Commit(); err != nil {
+			return Session{}, err
+		}
+		return session, ErrorRefreshTokenReused
+	}
+	if err != nil {
+		return Session{}, err
+	}
+
+	if newRefreshToken != "" {
+		_, err = tx.Exec(
+			`INSERT INTO session_rotated_tokens (token_hash, session_id, generation)
+			SELECT ?1, ?2, COALESCE(MAX(generation), 0) + 1 FROM session_rotated_tokens WHERE session_id = ?2`,
+			session.TokenHash, session.Id,
+		)
+		if err != nil {
+			return Session{}, err
+		}
+		_, err = tx.Exec(
+			`DELETE FROM session_rotated_tokens WHERE session_id = ?1 AND generation <=
+				(SELECT MAX(generation) FROM session_rotated_tokens WHERE session_id = ?1) - ?2`,
+			session.Id, maxRotatedTokens,
+		)
+		if err != nil {
+			return Session{}, err
+		}
+		session.TokenHash = db.tokens.hash(newRefreshToken)
+	}
+	session.LastUsedAt = usedAt
+
+	_, err = tx.Exec(
+		"UPDATE sessions SET token_hash = ?, last_used_at = ? WHERE id = ?",
+		session.TokenHash, session.LastUsedAt.UnixNano(), session.Id,
+	)
+	if err != nil {
+		return Session{}, err
+	}
+
+	return session, tx.Commit()
+}
+
+func (db *SQLiteDB) RevokeRefreshToken(refreshToken string) error {
+	res, err := db.conn.Exec("DELETE FROM sessions WHERE token_hash = ?", db.tokens.hash(refreshToken))
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrorInvalidRefreshToken
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) GetSessions(userId int) ([]Session, error) {
+	rows, err := db.conn.Query(
+		"SELECT "+sqliteSessionColumns+" FROM sessions WHERE user_id = ? AND expires_at > ? ORDER BY id",
+		userId, now().UnixNano(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (db *SQLiteDB) PurgeExpiredSessions() (int, error) {
+	res, err := db.conn.Exec("DELETE FROM sessions WHERE expires_at <= ?", now().UnixNano())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (db *SQLiteDB) RevokeSession(userId int, sessionId int) error {
+	res, err := db.conn.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", sessionId, userId)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrorSessionNotFound
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) RevokeAllTokens(userId int) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE users SET token_version = token_version + 1 WHERE id = ?", userId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrorUserNotFound
+	}
+
+	_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) TokenVersion(userId int) (int, error) {
+	var tokenVersion int
+	err := db.conn.QueryRow("SELECT token_version FROM users WHERE id = ?", userId).Scan(&tokenVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrorUserNotFound
+	}
+	return tokenVersion, err
+}
+
+func (db *SQLiteDB) userExists(userId int) (bool, error) {
+	var exists bool
+	err := db.conn.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", userId).Scan(&exists)
+	return exists, err
+}
+
+func (db *SQLiteDB) Follow(followerId int, followeeId int) error {
+	if followerId == followeeId {
+		return ErrorCannotFollowSelf
+	}
+
+	for _, id := range []int{followerId, followeeId} {
+		exists, err := db.userExists(id)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrorUserNotFound
+		}
+	}
+
+	_, err := db.conn.Exec("INSERT OR IGNORE INTO follows (follower_id, followee_id) VALUES (?, ?)", followerId, followeeId)
+	return err
+}
+
+func (db *SQLiteDB) Unfollow(followerId int, followeeId int) error {
+	exists, err := db.userExists(followeeId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrorUserNotFound
+	}
+
+	_, err = db.conn.Exec("DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", followerId, followeeId)
+	return err
+}
+
+func (db *SQLiteDB) GetFollowers(q FollowQuery) (UserPage, error) {
+	return db.userPage(q, "SELECT follower_id FROM follows WHERE followee_id = ?")
+}
+
+func (db *SQLiteDB) GetFollowing(q FollowQuery) (UserPage, error) {
+	return db.userPage(q, "SELECT followee_id FROM follows WHERE follower_id = ?")
+}
+
+// userPage pages through the users whose ids the subquery ids selects for
+// q.UserId.
+func (db *SQLiteDB) userPage(q FollowQuery, ids string) (UserPage, error) {
+	q, c, err := q.normalize()
+	if err != nil {
+		return UserPage{}, err
+	}
+
+	exists, err := db.userExists(q.UserId)
+	if err != nil {
+		return UserPage{}, err
+	}
+	if !exists {
+		return UserPage{}, ErrorUserNotFound
+	}
+
+	// Fetch one extra row to learn whether there is a next page.
+	rows, err := db.conn.Query(
+		"SELECT "+sqliteUserColumns+" FROM users WHERE id IN ("+ids+") AND id > ? ORDER BY id LIMIT ?",
+		q.UserId, c.Id, q.Limit+1,
+	)
+	if err != nil {
+		return UserPage{}, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return UserPage{}, err
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return UserPage{}, err
+	}
+
+	page := UserPage{Users: users}
+	if len(users) > q.Limit {
+		page.Users = users[:q.Limit]
+		page.NextCursor = cursor{Sort: SortAsc, Id: page.Users[q.Limit-1].Id}.encode()
+	}
+	return page, nil
+}
+
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
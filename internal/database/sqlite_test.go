@@ -0,0 +1,321 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestSQLiteDB(t *testing.T) *SQLiteDB {
+	t.Helper()
+	db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.test.sqlite"), Options{Mode: ModeDev})
+	if err != nil {
+		t.Fatalf("NewSQLiteDB resulted in an error: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLiteMigrationsAreIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.test.sqlite")
+	db, err := NewSQLiteDB(path, Options{Mode: ModeDev})
+	if err != nil {
+		t.Fatalf("NewSQLiteDB resulted in an error: %v", err)
+	}
+	if _, err := db.CreateChirp("test chirp", 1); err != nil {
+		t.Fatalf("CreateChirp resulted in an error: %v", err)
+	}
+	db.Close()
+
+	db, err = NewSQLiteDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("Reopening resulted in an error: %v", err)
+	}
+	defer db.Close()
+
+	var version int
+	db.conn.QueryRow("PRAGMA user_version").Scan(&version)
+	if version != len(sqliteMigrations) {
+		t.Errorf("Expected schema version %d, got %d", len(sqliteMigrations), version)
+	}
+
+	chirps, err := allChirps(db)
+	if err != nil {
+		t.Fatalf("GetChirps resulted in an error: %v", err)
+	}
+	if len(chirps) != 1 || chirps[0].Body != "test chirp" {
+		t.Errorf("Expected the chirp to survive reopening, got %v", chirps)
+	}
+}
+
+func TestSQLiteChirps(t *testing.T) {
+	db := newTestSQLiteDB(t)
+
+	chirp, err := db.CreateChirp("test chirp", 1)
+	if err != nil {
+		t.Fatalf("CreateChirp resulted in an error: %v", err)
+	}
+
+	got, err := db.GetChirp(chirp.Id)
+	if err != nil {
+		t.Fatalf("GetChirp resulted in an error: %v", err)
+	}
+	if !reflect.DeepEqual(got, chirp) {
+		t.Errorf("Expected %v, got %v", chirp, got)
+	}
+
+	if err := db.DeleteChirp(chirp.Id, 2); err == nil {
+		t.Errorf("Expected deleting another author's chirp to fail")
+	}
+
+	if err := db.DeleteChirp(chirp.Id, 1); err != nil {
+		t.Fatalf("DeleteChirp resulted in an error: %v", err)
+	}
+
+	if _, err := db.GetChirp(chirp.Id); !errors.Is(err, ErrorChirpDoesNotExist) {
+		t.Errorf("Expected ErrorChirpDoesNotExist, got %v", err)
+	}
+
+	next, err := db.CreateChirp("next chirp", 1)
+	if err != nil {
+		t.Fatalf("CreateChirp resulted in an error: %v", err)
+	}
+	if next.Id == chirp.Id {
+		t.Errorf("Expected the id of a deleted chirp not to be reused")
+	}
+}
+
+func TestSQLiteUsers(t *testing.T) {
+	db := newTestSQLiteDB(t)
+
+	user, err := db.CreateUser("walt@breakingbad.com", "123456")
+	if err != nil {
+		t.Fatalf("CreateUser resulted in an error: %v", err)
+	}
+
+	if _, err := db.CreateUser("walt@breakingbad.com", "654321"); !errors.Is(err, ErrorDuplicatedUser) {
+		t.Errorf("Expected ErrorDuplicatedUser, got %v", err)
+	}
+
+	if _, err := db.Login("walt@breakingbad.com", "wrong"); err == nil {
+		t.Errorf("Expected login with the wrong password to fail")
+	}
+
+	if _, err := db.Login("walt@breakingbad.com", "123456"); err != nil {
+		t.Errorf("Login resulted in an error: %v", err)
+	}
+
+	if _, err := db.StoreRefreshToken(user.Id, "token", time.Hour, Device{}); err != nil {
+		t.Fatalf("StoreRefreshToken resulted in an error: %v", err)
+	}
+
+	session, err := db.ValidateRefreshToken("token")
+	if err != nil || session.UserId != user.Id {
+		t.Errorf("ValidateRefreshToken returned %+v, %v", session, err)
+	}
+
+	if err := db.RevokeRefreshToken("token"); err != nil {
+		t.Fatalf("RevokeRefreshToken resulted in an error: %v", err)
+	}
+
+	if _, err := db.ValidateRefreshToken("token"); err == nil {
+		t.Errorf("Expected a revoked refresh token to be rejected")
+	}
+}
+
+func TestSQLiteBackupAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "database.sqlite")
+
+	db, err := NewSQLiteDB(path, Options{Mode: ModeDev})
+	if err != nil {
+		t.Fatalf("NewSQLiteDB resulted in an error: %v", err)
+	}
+
+	db.CreateChirp("before backup", 1)
+
+	backup, err := db.Backup(filepath.Join(dir, "backups"), 7)
+	if err != nil {
+		t.Fatalf("Backup resulted in an error: %v", err)
+	}
+
+	db.CreateChirp("after backup", 1)
+	db.Close()
+
+	if err := Restore("sqlite", backup, path); err != nil {
+		t.Fatalf("Restore resulted in an error: %v", err)
+	}
+
+	db, err = NewSQLiteDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("Reopening resulted in an error: %v", err)
+	}
+	defer db.Close()
+
+	chirps, _ := allChirps(db)
+	if len(chirps) != 1 || chirps[0].Body != "before backup" {
+		t.Errorf("Expected only the chirp from before the backup, got %v", chirps)
+	}
+}
+
+func TestSQLiteGetChirpsPagination(t *testing.T) {
+	db := newTestSQLiteDB(t)
+
+	for i := 1; i <= 7; i++ {
+		db.CreateChirp(fmt.Sprintf("chirp %d", i), i%2)
+	}
+	db.DeleteChirp(4, 0)
+
+	testChirpPagination(t, db)
+}
+
+func TestSQLiteSearchChirps(t *testing.T) {
+	db := newTestSQLiteDB(t)
+
+	createSearchChirps(db)
+	testChirpSearch(t, db)
+}
+
+func TestSQLiteHashtags(t *testing.T) {
+	testHashtags(t, newTestSQLiteDB(t))
+}
+
+func TestSQLiteBackfillMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.test.sqlite")
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("sql.Open resulted in an error: %v", err)
+	}
+	for _, m := range sqliteMigrations[:2] {
+		if _, err := conn.Exec(m.sql); err != nil {
+			t.Fatalf("Creating the old schema resulted in an error: %v", err)
+		}
+	}
+	conn.Exec("PRAGMA user_version = 2")
+	conn.Exec("INSERT INTO users (email, password, refresh_token) VALUES ('walt@breakingbad.com', '', 'walts'), ('jesse@breakingbad.com', '', NULL)")
+	conn.Exec("INSERT INTO chirps (body, author_id) VALUES ('#Go rocks @jesse', 1), ('plain', 1)")
+	conn.Close()
+
+	db, err := NewSQLiteDB(path, Options{Mode: ModePersistent})
+	if err != nil {
+		t.Fatalf("NewSQLiteDB resulted in an error: %v", err)
+	}
+	defer db.Close()
+
+	page, _ := db.GetChirps(ChirpQuery{Hashtag: "go"})
+	if len(page.Chirps) != 1 || fmt.Sprint(page.Chirps[0].Tags()) != "[go]" {
+		t.Errorf("Expected chirp 1 to be tagged go, got %v", page.Chirps)
+	}
+	trending, _ := db.TrendingHashtags(TrendingQuery{Window: MaxTrendingWindow})
+	if len(trending) != 0 {
+		t.Errorf("Expected migrated tags not to trend, got %v", trending)
+	}
+
+	page, _ = db.GetChirps(ChirpQuery{MentionId: 2})
+	if len(page.Chirps) != 1 || fmt.Sprint(page.Chirps[0].Mentions) != "[2]" {
+		t.Errorf("Expected chirp 1 to mention user 2, got %v", page.Chirps)
+	}
+
+	if session, err := db.ValidateRefreshToken("walts"); err != nil || session.UserId != 1 {
+		t.Errorf("Expected walt's refresh token to become a session, got %+v, %v", session, err)
+	}
+	if sessions, _ := db.GetSessions(2); len(sessions) != 0 {
+		t.Errorf("Expected no session for a user without a refresh token, got %v", sessions)
+	}
+}
+
+func TestSQLiteMentions(t *testing.T) {
+	testMentions(t, newTestSQLiteDB(t))
+}
+
+func TestSQLiteThreads(t *testing.T) {
+	testThreads(t, newTestSQLiteDB(t))
+}
+
+func TestSQLiteFollows(t *testing.T) {
+	testFollows(t, newTestSQLiteDB(t))
+}
+
+func TestSQLiteLikes(t *testing.T) {
+	testLikes(t, newTestSQLiteDB(t))
+}
+
+func TestSQLiteRechirps(t *testing.T) {
+	testRechirps(t, newTestSQLiteDB(t))
+}
+
+func TestSQLiteRevisions(t *testing.T) {
+	testRevisions(t, newTestSQLiteDB(t))
+}
+
+func TestSQLiteTimestamps(t *testing.T) {
+	testTimestamps(t, newTestSQLiteDB(t))
+}
+
+func TestSQLiteFlags(t *testing.T) {
+	testFlags(t, newTestSQLiteDB(t))
+}
+
+func TestSQLiteSessions(t *testing.T) {
+	testSessions(t, newTestSQLiteDB(t))
+}
+
+func TestSQLiteSessionExpiry(t *testing.T) {
+	testSessionExpiry(t, newTestSQLiteDB(t))
+}
+
+func TestSQLiteRefreshTokenRotation(t *testing.T) {
+	testRefreshTokenRotation(t, newTestSQLiteDB(t))
+}
+
+func TestSQLiteRotatedTokensAreCapped(t *testing.T) {
+	testRotatedTokensAreCapped(t, newTestSQLiteDB(t))
+}
+
+// A transaction that reads and then writes, as refreshing a token does,
+// must not fail because another connection wrote in between.
+func TestSQLiteTransactionsLockForWriting(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	db.CreateUser("alice@example.com", "123456")
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		t.Fatalf("Begin resulted in an error: %v", err)
+	}
+	defer tx.Rollback()
+	var sessions int
+	tx.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&sessions)
+
+	done := make(chan error)
+	go func() {
+		_, err := db.StoreRefreshToken(1, "phone-token", time.Hour, Device{})
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	_, err = tx.Exec("INSERT INTO settings (name, value) VALUES ('test', ?)", sessions)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		t.Errorf("Writing after a read resulted in an error: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("StoreRefreshToken resulted in an error: %v", err)
+	}
+}
+
+func TestSQLiteRevokeAllTokens(t *testing.T) {
+	testRevokeAllTokens(t, newTestSQLiteDB(t))
+}
+
+func TestSQLiteTokenKeying(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.test.sqlite")
+	testTokenKeying(t, func(key []byte) (Store, error) {
+		return NewSQLiteDB(path, Options{Mode: ModePersistent, TokenKey: key})
+	})
+}
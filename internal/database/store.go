@@ -0,0 +1,134 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// Store is the storage backend the HTTP handlers talk to. DB keeps
+// everything in a single JSON file, SQLiteDB in a SQLite database.
+type Store interface {
+	CreateChirp(body string, authorId int) (Chirp, error)
+	CreateReply(body string, authorId int, inReplyTo int) (Chirp, error)
+	// CreateRechirp and CreateQuote share a chirp. Replying to, quoting or
+	// rechirping a rechirp acts on its original.
+	CreateRechirp(authorId int, chirpId int) (Chirp, error)
+	CreateQuote(body string, authorId int, quoteOf int) (Chirp, error)
+	GetChirps(q ChirpQuery) (ChirpPage, error)
+	SearchChirps(q SearchQuery) ([]Chirp, error)
+	TrendingHashtags(q TrendingQuery) ([]TrendingHashtag, error)
+	GetChirp(id int) (Chirp, error)
+	GetThread(id int, depth int) (ThreadNode, error)
+	// DeleteChirp removes one of authorId's chirps along with its rechirps.
+	// Replies and quotes are kept and still point at it; see ThreadNode.
+	DeleteChirp(id, authorId int) error
+	// UpdateChirp edits the body of one of authorId's chirps. The body it
+	// replaces is kept and returned by GetRevisions.
+	UpdateChirp(id int, authorId int, body string) (Chirp, error)
+	GetRevisions(id int) ([]Revision, error)
+	LikeChirp(chirpId int, userId int) error
+	UnlikeChirp(chirpId int, userId int) error
+	// LikedChirps reports which of chirpIds userId likes. Chirps read from
+	// the store carry their like count but not who liked them.
+	LikedChirps(userId int, chirpIds []int) (map[int]bool, error)
+	// FlagChirp holds a chirp for review by the moderation rules it
+	// matched; no rules clears the flag. Deleting the chirp drops it too.
+	FlagChirp(chirpId int, rules []string) error
+	GetFlags() ([]Flag, error)
+
+	CreateUser(email string, password string) (User, error)
+	UpdateUser(userId int, newEmail string, newPassword string) (User, error)
+	UpgradeUser(userId int) (User, error)
+	GetUser(userId int) (User, error)
+	// UpdateUser and RevokeAllTokens sign the user out everywhere, the
+	// former only when the password changes: every session ends and
+	// TokenVersion goes up, so access tokens already issued stop
+	// validating.
+	RevokeAllTokens(userId int) error
+	TokenVersion(userId int) (int, error)
+	Login(email string, password string) (User, error)
+
+	Follow(followerId int, followeeId int) error
+	Unfollow(followerId int, followeeId int) error
+	GetFollowers(q FollowQuery) (UserPage, error)
+	GetFollowing(q FollowQuery) (UserPage, error)
+
+	// StoreRefreshToken starts a session for userId on device. Users may
+	// be signed in on any number of devices, each with its own refresh
+	// token, of which only a hash is stored.
+	StoreRefreshToken(userId int, refreshToken string, expireIn time.Duration, device Device) (Session, error)
+	// ValidateRefreshToken returns the session refreshToken belongs to and
+	// records that it was used. An expired token gives
+	// ErrorRefreshTokenExpired. A token RotateRefreshToken replaced revokes
+	// its session and gives ErrorRefreshTokenReused with that session.
+	ValidateRefreshToken(refreshToken string) (Session, error)
+	// RotateRefreshToken validates refreshToken as ValidateRefreshToken
+	// does and replaces it with newRefreshToken.
+	RotateRefreshToken(refreshToken string, newRefreshToken string) (Session, error)
+	RevokeRefreshToken(refreshToken string) error
+	// GetSessions leaves out expired sessions, which stay stored until
+	// PurgeExpiredSessions deletes them.
+	GetSessions(userId int) ([]Session, error)
+	PurgeExpiredSessions() (int, error)
+	// RevokeSession ends one of userId's sessions.
+	RevokeSession(userId int, sessionId int) error
+
+	Backup(dir string, keep int) (string, error)
+	Close() error
+}
+
+// Options configures how a Store is opened.
+type Options struct {
+	Mode Mode
+
+	// WriteAheadLog makes the JSON store append each write to path+".wal"
+	// instead of rewriting the whole file. The log is folded into the
+	// snapshot on startup and every CompactEvery writes (1000 if unset).
+	WriteAheadLog bool
+	CompactEvery  int
+
+	// Durability decides when the JSON store writes its snapshot when the
+	// log is off. DurabilityDebounced batches writes into one flush per
+	// FlushInterval (1s if unset), trading that window of data for speed.
+	Durability    Durability
+	FlushInterval time.Duration
+
+	// TokenKey keys the hash refresh tokens are stored under, so a copy of
+	// the store alone can't be used to look sessions up. A store written
+	// without a key is rekeyed the first time it is opened with one; after
+	// that, opening it with another key gives ErrorTokenKeyMismatch.
+	TokenKey []byte
+}
+
+type Durability int
+
+const (
+	// DurabilitySync persists every write before the call returns.
+	DurabilitySync Durability = iota
+	// DurabilityDebounced persists writes in the background.
+	DurabilityDebounced
+)
+
+// ParseDurability maps the DB_DURABILITY setting onto a Durability. An
+// empty string selects DurabilitySync.
+func ParseDurability(s string) (Durability, error) {
+	switch s {
+	case "", "sync":
+		return DurabilitySync, nil
+	case "debounced":
+		return DurabilityDebounced, nil
+	}
+	return DurabilitySync, fmt.Errorf("unknown durability %q", s)
+}
+
+// Open returns the Store for driver, which is either "json" or "sqlite".
+// An empty driver selects "json".
+func Open(driver string, path string, opts Options) (Store, error) {
+	switch driver {
+	case "", "json":
+		return NewDB(path, opts)
+	case "sqlite":
+		return NewSQLiteDB(path, opts)
+	}
+	return nil, fmt.Errorf("unknown database driver %q", driver)
+}
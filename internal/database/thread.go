@@ -0,0 +1,122 @@
+package database
+
+import "errors"
+
+var ErrorParentChirpDoesNotExist = errors.New("Chirp being replied to doesn't exist")
+
+const (
+	DefaultThreadDepth = 10
+	MaxThreadDepth     = 50
+)
+
+// ThreadNode is a chirp in a conversation along with the replies to it.
+//
+// Deleting a chirp never deletes its replies. If the deleted chirp had
+// replies, its id and parent are kept as a tombstone so the conversation
+// stays connected: the node is returned with Deleted set and only Chirp.Id
+// filled in. Deleted chirps without replies are left out.
+type ThreadNode struct {
+	Chirp   Chirp
+	Deleted bool
+	// ReplyCount is the number of entries Replies holds, or would hold if
+	// the node were not at the depth limit.
+	ReplyCount int
+	Replies    []ThreadNode
+}
+
+// threadSource abstracts the two lookups building a thread needs, so both
+// stores can share buildThread.
+type threadSource struct {
+	// chirp returns a live chirp.
+	chirp func(id int) (Chirp, bool)
+	// replies returns the ids of live and tombstoned replies to id in
+	// ascending order.
+	replies func(id int) []int
+}
+
+// visibleReplies drops tombstones that have nothing left under them.
+func (s threadSource) visibleReplies(id int) []int {
+	visible := []int{}
+	for _, reply := range s.replies(id) {
+		if _, ok := s.chirp(reply); ok || len(s.replies(reply)) > 0 {
+			visible = append(visible, reply)
+		}
+	}
+	return visible
+}
+
+// buildThread returns the tree under id, depth levels of replies deep.
+func (s threadSource) buildThread(id int, depth int) ThreadNode {
+	node := ThreadNode{Chirp: Chirp{Id: id}}
+	if chirp, ok := s.chirp(id); ok {
+		node.Chirp = chirp
+	} else {
+		node.Deleted = true
+	}
+
+	replies := s.visibleReplies(id)
+	node.ReplyCount = len(replies)
+	if depth == 0 {
+		return node
+	}
+	for _, reply := range replies {
+		node.Replies = append(node.Replies, s.buildThread(reply, depth-1))
+	}
+	return node
+}
+
+func normalizeThreadDepth(depth int) int {
+	if depth <= 0 {
+		return DefaultThreadDepth
+	}
+	return min(depth, MaxThreadDepth)
+}
+
+func (db *DB) CreateReply(body string, authorId int, inReplyTo int) (Chirp, error) {
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	parent, ok := db.resolveRechirp(inReplyTo)
+	if !ok {
+		return Chirp{}, ErrorParentChirpDoesNotExist
+	}
+
+	return db.createChirp(Chirp{Body: body, AuthorId: authorId, InReplyTo: parent.Id})
+}
+
+// GetThread returns the whole conversation id belongs to, starting from its
+// root and going at most depth levels of replies deep.
+func (db *DB) GetThread(id int, depth int) (ThreadNode, error) {
+	depth = normalizeThreadDepth(depth)
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	if _, ok := db.data.Chirps[id]; !ok {
+		return ThreadNode{}, ErrorChirpDoesNotExist
+	}
+
+	root := id
+	for {
+		parent := db.data.Tombstones[root]
+		if chirp, ok := db.data.Chirps[root]; ok {
+			parent = chirp.InReplyTo
+		}
+		if parent == 0 {
+			break
+		}
+		root = parent
+	}
+
+	source := threadSource{
+		chirp: func(id int) (Chirp, bool) {
+			chirp, ok := db.data.Chirps[id]
+			return db.view(chirp), ok
+		},
+		replies: func(id int) []int {
+			return db.chirpsByParent[id]
+		},
+	}
+	return source.buildThread(root, depth), nil
+}
@@ -2,7 +2,6 @@ package database
 
 import (
 	"errors"
-	"log"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -16,46 +15,38 @@ type User struct {
 	Email       string `json:"email"`
 	Password    string `json:"password"`
 	IsChirpyRed bool   `json:"is_chirpy_red"`
-	RefreshToken
-}
-
-type RefreshToken struct {
-	Token     string `json:"refresh_token"`
-	expiresIn time.Duration
+	// CreatedAt and UpdatedAt are nil for users created before they were
+	// recorded.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	// TokenVersion goes up each time the user is signed out everywhere.
+	// Access tokens carry the version they were issued under and stop
+	// validating once it changes.
+	TokenVersion int `json:"token_version,omitempty"`
 }
 
 func (db *DB) CreateUser(email string, password string) (User, error) {
 
-	dbStructure, err := db.loadDB()
-	if err != nil && !errors.Is(err, ErrorEmptyFile) {
-		log.Fatal(err)
+	// bcrypt is slow on purpose, so hash before taking the lock.
+	hashPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
 		return User{}, err
 	}
 
-	if errors.Is(err, ErrorEmptyFile) {
-		dbStructure = DBStructure{
-			Chirps: make(map[int]Chirp),
-			Users:  make(map[int]User),
-		}
-	}
-
-	if _, err := dbStructure.findUserByEmail(email); err == nil {
-		return User{}, errors.New("User has already been created")
-	}
+	db.mux.Lock()
+	defer db.mux.Unlock()
 
-	userId := len(dbStructure.Users) + 1
-	hashPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return User{}, err
+	if _, ok := db.usersByEmail[email]; ok {
+		return User{}, ErrorDuplicatedUser
 	}
 
-	user := User{Id: userId, Email: email, Password: string(hashPassword), IsChirpyRed: false}
+	userId := db.data.Sequences.Users + 1
 
-	dbStructure.Users[userId] = user
+	createdAt := now().UTC()
+	user := User{Id: userId, Email: email, Password: string(hashPassword), IsChirpyRed: false, CreatedAt: &createdAt, UpdatedAt: &createdAt}
 
-	err = db.writeDB(dbStructure)
+	err = db.save(walEntry{Op: opPutUser, User: &user})
 	if err != nil {
-		log.Fatal(err)
 		return User{}, err
 	}
 
@@ -64,37 +55,44 @@ func (db *DB) CreateUser(email string, password string) (User, error) {
 
 func (db *DB) UpdateUser(userId int, newEmail string, newPassword string) (User, error) {
 
-	dbStructure, err := db.loadDB()
-	if err != nil && !errors.Is(err, ErrorEmptyFile) {
-		log.Fatal(err)
-		return User{}, err
-	}
-
-	if errors.Is(err, ErrorEmptyFile) {
-		dbStructure = DBStructure{
-			Chirps: make(map[int]Chirp),
-			Users:  make(map[int]User),
-		}
-	}
-
 	hashPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
 	if err != nil {
 		return User{}, err
 	}
 
-	user, ok := dbStructure.Users[userId]
+	// Comparing is as slow as hashing, so it happens before taking the
+	// lock too.
+	db.mux.RLock()
+	old, ok := db.data.Users[userId]
+	db.mux.RUnlock()
+	passwordChanged := !ok || bcrypt.CompareHashAndPassword([]byte(old.Password), []byte(newPassword)) != nil
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	user, ok := db.data.Users[userId]
 	if !ok {
 		return User{}, errors.New("Unable to find user")
 	}
 
+	if otherId, ok := db.usersByEmail[newEmail]; ok && otherId != userId {
+		return User{}, ErrorDuplicatedUser
+	}
+
+	// The password may have changed again since it was compared.
+	passwordChanged = passwordChanged || user.Password != old.Password
+
+	updatedAt := now().UTC()
 	user.Email = newEmail
 	user.Password = string(hashPassword)
+	user.UpdatedAt = &updatedAt
 
-	dbStructure.Users[userId] = user
-
-	err = db.writeDB(dbStructure)
+	entry := walEntry{Op: opPutUser, User: &user}
+	if passwordChanged {
+		entry = db.revokeTokens(&user)
+	}
+	err = db.save(entry)
 	if err != nil {
-		log.Fatal(err)
 		return User{}, err
 	}
 
@@ -103,66 +101,45 @@ func (db *DB) UpdateUser(userId int, newEmail string, newPassword string) (User,
 
 func (db *DB) UpgradeUser(userId int) (User, error) {
 
-	dbStructure, err := db.loadDB()
-	if err != nil && !errors.Is(err, ErrorEmptyFile) {
-		log.Fatal(err)
-		return User{}, err
-	}
+	db.mux.Lock()
+	defer db.mux.Unlock()
 
-	if errors.Is(err, ErrorEmptyFile) {
-		dbStructure = DBStructure{
-			Chirps: make(map[int]Chirp),
-			Users:  make(map[int]User),
-		}
-	}
-
-	user, ok := dbStructure.Users[userId]
+	user, ok := db.data.Users[userId]
 	if !ok {
 		return User{}, errors.New("Unable to find user")
 	}
 
+	updatedAt := now().UTC()
 	user.IsChirpyRed = true
+	user.UpdatedAt = &updatedAt
 
-	dbStructure.Users[userId] = user
-
-	err = db.writeDB(dbStructure)
+	err := db.save(walEntry{Op: opPutUser, User: &user})
 	if err != nil {
-		log.Fatal(err)
 		return User{}, err
 	}
 
 	return user, nil
 }
 
-func (d *DBStructure) findUserByEmail(email string) (User, error) {
-	for _, user := range d.Users {
-		if user.Email == email {
-			return user, nil
-		}
+func (db *DB) GetUser(userId int) (User, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	user, ok := db.data.Users[userId]
+	if !ok {
+		return User{}, ErrorUserNotFound
 	}
-	return User{}, ErrorUserNotFound
+	return user, nil
 }
 
 func (db *DB) Login(email string, password string) (User, error) {
 
-	dbStructure, err := db.loadDB()
-	if err != nil && !errors.Is(err, ErrorEmptyFile) {
-		log.Fatal(err)
-		return User{}, err
-	}
-
-	if errors.Is(err, ErrorEmptyFile) {
-		dbStructure = DBStructure{
-			Chirps: make(map[int]Chirp),
-			Users:  make(map[int]User),
-		}
-	}
-
-	user, err := dbStructure.findUserByEmail(email)
+	user, err := db.getUserByEmail(email)
 	if err != nil {
 		return User{}, err
 	}
 
+	// Compare outside the lock; bcrypt would otherwise stall every writer.
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 	if err != nil {
 		return User{}, err
@@ -170,92 +147,14 @@ func (db *DB) Login(email string, password string) (User, error) {
 	return user, nil
 }
 
-func (db *DB) StoreRefreshToken(userId int, refreshTokenString string, expireIn time.Duration) error {
-
-	dbStructure, err := db.loadDB()
-	if err != nil && !errors.Is(err, ErrorEmptyFile) {
-		log.Fatal(err)
-		return err
-	}
-
-	if errors.Is(err, ErrorEmptyFile) {
-		dbStructure = DBStructure{
-			Chirps: make(map[int]Chirp),
-			Users:  make(map[int]User),
-		}
-	}
+func (db *DB) getUserByEmail(email string) (User, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 
-	user, ok := dbStructure.Users[userId]
+	userId, ok := db.usersByEmail[email]
 	if !ok {
-		return errors.New("Couldn't find the user")
+		return User{}, ErrorUserNotFound
 	}
 
-	user.RefreshToken.Token = refreshTokenString
-	user.RefreshToken.expiresIn = expireIn
-
-	dbStructure.Users[userId] = user
-
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		log.Fatal(err)
-		return err
-	}
-
-	return nil
-}
-
-func (db *DB) ValidateRefreshToken(refreshToken string) (int, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil && !errors.Is(err, ErrorEmptyFile) {
-		log.Fatal(err)
-		return 0, err
-	}
-
-	if errors.Is(err, ErrorEmptyFile) {
-		dbStructure = DBStructure{
-			Chirps: make(map[int]Chirp),
-			Users:  make(map[int]User),
-		}
-	}
-
-	for _, user := range dbStructure.Users {
-		if user.RefreshToken.Token == refreshToken {
-			return user.Id, nil
-		}
-	}
-
-	return 0, errors.New("Unable to Validate Refresh Token")
-
-}
-
-func (db *DB) RevokeRefreshToken(refreshToken string) error {
-	dbStructure, err := db.loadDB()
-	if err != nil && !errors.Is(err, ErrorEmptyFile) {
-		log.Fatal(err)
-		return err
-	}
-
-	if errors.Is(err, ErrorEmptyFile) {
-		dbStructure = DBStructure{
-			Chirps: make(map[int]Chirp),
-			Users:  make(map[int]User),
-		}
-	}
-
-	for _, user := range dbStructure.Users {
-		if user.RefreshToken.Token == refreshToken {
-			user.RefreshToken.Token = ""
-
-			dbStructure.Users[user.Id] = user
-			err = db.writeDB(dbStructure)
-			if err != nil {
-				log.Fatal(err)
-				return err
-			}
-			return nil
-		}
-	}
-
-	return errors.New("Unable to find token to revoke")
-
+	return db.data.Users[userId], nil
 }
@@ -0,0 +1,373 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"time"
+)
+
+const defaultCompactEvery = 1000
+const defaultFlushInterval = time.Second
+
+const (
+	opPutChirp      = "put_chirp"
+	opEditChirp     = "edit_chirp"
+	opDeleteChirp   = "delete_chirp"
+	opPutUser       = "put_user"
+	opFollow        = "follow"
+	opUnfollow      = "unfollow"
+	opLike          = "like"
+	opUnlike        = "unlike"
+	opFlagChirp     = "flag_chirp"
+	opPutSession    = "put_session"
+	opDeleteSession = "delete_session"
+	opPurgeSessions = "purge_sessions"
+	opRevokeTokens  = "revoke_tokens"
+)
+
+// walEntry is one line of the append-only operation log. Entries carry the
+// full record they write, so replaying an entry that already made it into the
+// snapshot is harmless.
+type walEntry struct {
+	Op    string `json:"op"`
+	Id    int    `json:"id,omitempty"`
+	Chirp *Chirp `json:"chirp,omitempty"`
+	User  *User  `json:"user,omitempty"`
+	// Tombstone marks a delete_chirp that keeps a tombstone for the chirp.
+	Tombstone bool `json:"tombstone,omitempty"`
+	// Rechirps lists the rechirps a delete_chirp takes with it.
+	Rechirps []int   `json:"rechirps,omitempty"`
+	Follow   *Follow `json:"follow,omitempty"`
+	Like     *Like   `json:"like,omitempty"`
+	// Revision is the body an edit_chirp replaces, and RevisionIndex where
+	// it goes among the chirp's revisions. A snapshot that already holds
+	// that many revisions took the edit before the log was removed, so
+	// replaying it adds nothing. Logs written before the index was recorded
+	// leave it nil.
+	Revision      *Revision `json:"revision,omitempty"`
+	RevisionIndex *int      `json:"revision_index,omitempty"`
+	// Flag is a flag_chirp's new flag; one without rules clears it.
+	Flag    *Flag    `json:"flag,omitempty"`
+	Session *Session `json:"session,omitempty"`
+	// Ids lists the sessions a purge_sessions or revoke_tokens deletes.
+	Ids []int `json:"ids,omitempty"`
+}
+
+// check reports an entry that can't be applied to d, so save can reject
+// it before it is persisted.
+func (e walEntry) check(d *DBStructure) error {
+	switch e.Op {
+	case opPutChirp:
+		if e.Chirp == nil {
+			return errors.New("put_chirp without a chirp")
+		}
+	case opEditChirp:
+		if e.Chirp == nil || e.Revision == nil {
+			return errors.New("edit_chirp without a chirp and revision")
+		}
+		if _, ok := d.Chirps[e.Chirp.Id]; !ok {
+			return fmt.Errorf("edit_chirp of missing chirp %d", e.Chirp.Id)
+		}
+	case opDeleteChirp, opDeleteSession, opPurgeSessions:
+	case opPutUser:
+		if e.User == nil {
+			return errors.New("put_user without a user")
+		}
+	case opFollow:
+		if e.Follow == nil {
+			return errors.New("follow without a follow")
+		}
+	case opUnfollow:
+		if e.Follow == nil {
+			return errors.New("unfollow without a follow")
+		}
+	case opLike:
+		if e.Like == nil {
+			return errors.New("like without a like")
+		}
+	case opUnlike:
+		if e.Like == nil {
+			return errors.New("unlike without a like")
+		}
+	case opFlagChirp:
+		if e.Flag == nil {
+			return errors.New("flag_chirp without a flag")
+		}
+	case opPutSession:
+		if e.Session == nil {
+			return errors.New("put_session without a session")
+		}
+	case opRevokeTokens:
+		if e.User == nil {
+			return errors.New("revoke_tokens without a user")
+		}
+	default:
+		return fmt.Errorf("unknown op %q", e.Op)
+	}
+	return nil
+}
+
+// apply applies entry to d. It never modifies a slice it finds in d, as
+// save applies entries to a clone that shares them with the live store.
+func (e walEntry) apply(d *DBStructure) error {
+	err := e.check(d)
+	if err != nil {
+		return err
+	}
+
+	if d.Chirps == nil {
+		d.Chirps = make(map[int]Chirp)
+	}
+	if d.Users == nil {
+		d.Users = make(map[int]User)
+	}
+	if d.Tombstones == nil {
+		d.Tombstones = make(map[int]int)
+	}
+	if d.Follows == nil {
+		d.Follows = make(map[int][]int)
+	}
+	if d.Likes == nil {
+		d.Likes = make(map[int][]int)
+	}
+	if d.Revisions == nil {
+		d.Revisions = make(map[int][]Revision)
+	}
+	if d.Flags == nil {
+		d.Flags = make(map[int]Flag)
+	}
+	if d.Sessions == nil {
+		d.Sessions = make(map[int]Session)
+	}
+
+	switch e.Op {
+	case opPutChirp:
+		d.Chirps[e.Chirp.Id] = *e.Chirp
+		d.Sequences.Chirps = max(d.Sequences.Chirps, e.Chirp.Id)
+	case opEditChirp:
+		d.Chirps[e.Chirp.Id] = *e.Chirp
+		revisions := d.Revisions[e.Chirp.Id]
+		if e.RevisionIndex == nil || len(revisions) <= *e.RevisionIndex {
+			d.Revisions[e.Chirp.Id] = append(slices.Clip(revisions), *e.Revision)
+		}
+	case opDeleteChirp:
+		if chirp, ok := d.Chirps[e.Id]; ok && e.Tombstone {
+			d.Tombstones[e.Id] = chirp.InReplyTo
+		}
+		for _, id := range append([]int{e.Id}, e.Rechirps...) {
+			delete(d.Chirps, id)
+			delete(d.Likes, id)
+			delete(d.Revisions, id)
+			delete(d.Flags, id)
+		}
+	case opPutUser:
+		d.Users[e.User.Id] = *e.User
+		d.Sequences.Users = max(d.Sequences.Users, e.User.Id)
+	case opFollow:
+		d.Follows[e.Follow.FollowerId] = insertId(slices.Clone(d.Follows[e.Follow.FollowerId]), e.Follow.FolloweeId)
+	case opUnfollow:
+		removeFromRecords(d.Follows, e.Follow.FollowerId, e.Follow.FolloweeId)
+	case opLike:
+		d.Likes[e.Like.ChirpId] = insertId(slices.Clone(d.Likes[e.Like.ChirpId]), e.Like.UserId)
+	case opUnlike:
+		removeFromRecords(d.Likes, e.Like.ChirpId, e.Like.UserId)
+	case opFlagChirp:
+		if len(e.Flag.Rules) == 0 {
+			delete(d.Flags, e.Flag.ChirpId)
+		} else {
+			d.Flags[e.Flag.ChirpId] = *e.Flag
+		}
+	case opPutSession:
+		d.Sessions[e.Session.Id] = *e.Session
+		d.Sequences.Sessions = max(d.Sequences.Sessions, e.Session.Id)
+	case opDeleteSession:
+		delete(d.Sessions, e.Id)
+	case opPurgeSessions:
+		for _, id := range e.Ids {
+			delete(d.Sessions, id)
+		}
+	case opRevokeTokens:
+		d.Users[e.User.Id] = *e.User
+		for _, id := range e.Ids {
+			delete(d.Sessions, id)
+		}
+	}
+	return nil
+}
+
+// removeFromRecords is removeFromIndex for the id lists in DBStructure,
+// which apply must not modify in place.
+func removeFromRecords(records map[int][]int, key int, id int) {
+	if _, ok := records[key]; ok {
+		records[key] = slices.Clone(records[key])
+	}
+	removeFromIndex(records, key, id)
+}
+
+func (db *DB) logPath() string {
+	return db.path + ".wal"
+}
+
+// persist makes entry durable before save applies it to db.data. With the
+// log, the entry is appended. Without it, the snapshot is rewritten straight
+// away, which needs the store as it will be once entry is applied: that is
+// returned for save to keep. With DurabilityDebounced nothing is written
+// until finishSave schedules a flush.
+func (db *DB) persist(entry walEntry) (next DBStructure, applied bool, err error) {
+	if db.opts.WriteAheadLog {
+		return DBStructure{}, false, db.appendLog(entry)
+	}
+	if db.opts.Durability == DurabilityDebounced {
+		return DBStructure{}, false, nil
+	}
+
+	next = db.data.clone()
+	err = entry.apply(&next)
+	if err == nil {
+		err = db.writeDB(next)
+	}
+	return next, err == nil, err
+}
+
+// finishSave follows up a write save has persisted and applied. The log is
+// folded into the snapshot every CompactEvery entries; a failed compaction
+// only delays that, as the entry is already in the log. With
+// DurabilityDebounced the snapshot is written by a flush scheduled
+// FlushInterval from the first unflushed write.
+func (db *DB) finishSave() {
+	if db.opts.WriteAheadLog {
+		db.logEntries++
+
+		compactEvery := db.opts.CompactEvery
+		if compactEvery <= 0 {
+			compactEvery = defaultCompactEvery
+		}
+		if db.logEntries >= compactEvery {
+			err := db.compact(db.data)
+			if err != nil {
+				log.Printf("Couldn't compact database: %s", err)
+			}
+		}
+		return
+	}
+
+	if db.opts.Durability == DurabilityDebounced {
+		db.dirty = true
+		if db.flushTimer == nil {
+			interval := db.opts.FlushInterval
+			if interval <= 0 {
+				interval = defaultFlushInterval
+			}
+			db.flushTimer = time.AfterFunc(interval, db.flush)
+		}
+	}
+}
+
+// flush writes out db.data after a debounced write. A failed flush stays
+// dirty and is retried by the next write or by Close.
+func (db *DB) flush() {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	db.flushTimer = nil
+	if !db.dirty {
+		return
+	}
+
+	data, err := json.Marshal(db.data)
+	if err == nil {
+		err = writeFileAtomic(db.path, data, 0644)
+	}
+	if err != nil {
+		log.Printf("Couldn't flush database: %s", err)
+		return
+	}
+	db.dirty = false
+}
+
+// appendLog writes entry to the log and fsyncs it before returning, so an
+// acknowledged write survives a crash.
+func (db *DB) appendLog(entry walEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	file, err := os.OpenFile(db.logPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readLog returns the entries in the log. A final line without a newline is
+// a write that was cut off by a crash before it was acknowledged, and is
+// skipped.
+func (db *DB) readLog() ([]walEntry, error) {
+	file, err := os.Open(db.logPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []walEntry{}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		entry := walEntry{}
+		err = json.Unmarshal(line, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s entry %d: %v", ErrorCorruptFile, db.logPath(), len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// compact writes dbStructure as the new snapshot and then drops the log. A
+// crash in between only means the next start replays entries the snapshot
+// already contains.
+func (db *DB) compact(dbStructure DBStructure) error {
+	err := db.writeDB(dbStructure)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(db.logPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	db.logEntries = 0
+
+	return nil
+}
@@ -0,0 +1,281 @@
+// Package moderation checks chirp bodies against a configurable list of
+// rules. Each rule matches either whole words or a regular expression and
+// then masks the match, rejects the chirp or flags it for review.
+package moderation
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+type Action string
+
+const (
+	ActionMask   Action = "mask"
+	ActionReject Action = "reject"
+	ActionFlag   Action = "flag"
+)
+
+// Mask replaces whatever a mask rule matches.
+const Mask = "****"
+
+// RuleConfig is one rule of a config file. A rule has either Words or
+// Pattern. Words match whole words, ignoring case and the punctuation
+// around them; bodies are expected in NFC, as chirptext.Normalize leaves
+// them. Pattern is a Go regular expression and is case sensitive
+// unless it starts with (?i).
+type RuleConfig struct {
+	Name    string   `json:"name"`
+	Words   []string `json:"words,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+	Action  Action   `json:"action"`
+}
+
+// Config is the format of the moderation config file. Rules run in order,
+// each on the body left by the rules before it.
+type Config struct {
+	Rules []RuleConfig `json:"rules"`
+}
+
+// DefaultConfig is used when no config file is given.
+var DefaultConfig = Config{
+	Rules: []RuleConfig{
+		{Name: "profanity", Words: []string{"kerfuffle", "sharbert", "fornax"}, Action: ActionMask},
+	},
+}
+
+// LoadConfig reads a config file. Unknown fields are an error, so a
+// misspelt key doesn't silently disable a rule.
+func LoadConfig(path string) (Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Config{}, err
+	}
+	defer file.Close()
+
+	config := Config{}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&config)
+	if err != nil {
+		return Config{}, fmt.Errorf("Couldn't parse %s: %w", path, err)
+	}
+	return config, nil
+}
+
+type rule struct {
+	name    string
+	action  Action
+	words   map[string]struct{}
+	pattern *regexp.Regexp
+}
+
+// RuleSet is a compiled Config.
+type RuleSet struct {
+	rules []rule
+}
+
+// Compile checks every rule and prepares it for matching.
+func (c Config) Compile() (*RuleSet, error) {
+	rules := &RuleSet{}
+	names := make(map[string]struct{}, len(c.Rules))
+	for i, rc := range c.Rules {
+		if rc.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i+1)
+		}
+		if _, ok := names[rc.Name]; ok {
+			return nil, fmt.Errorf("rule %q is defined twice", rc.Name)
+		}
+		names[rc.Name] = struct{}{}
+
+		switch rc.Action {
+		case ActionMask, ActionReject, ActionFlag:
+		default:
+			return nil, fmt.Errorf("rule %q has unknown action %q", rc.Name, rc.Action)
+		}
+
+		r := rule{name: rc.Name, action: rc.Action}
+		switch {
+		case len(rc.Words) > 0 && rc.Pattern != "":
+			return nil, fmt.Errorf("rule %q has both words and a pattern", rc.Name)
+		case len(rc.Words) > 0:
+			r.words = make(map[string]struct{}, len(rc.Words))
+			for _, word := range rc.Words {
+				if spans := wordSpans(word); len(spans) != 1 || spans[0] != [2]int{0, len(word)} {
+					return nil, fmt.Errorf("rule %q: %q is not a single word", rc.Name, word)
+				}
+				r.words[fold(norm.NFC.String(word))] = struct{}{}
+			}
+		case rc.Pattern != "":
+			pattern, err := regexp.Compile(rc.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", rc.Name, err)
+			}
+			r.pattern = pattern
+		default:
+			return nil, fmt.Errorf("rule %q has neither words nor a pattern", rc.Name)
+		}
+		rules.rules = append(rules.rules, r)
+	}
+	return rules, nil
+}
+
+// Len returns the number of rules.
+func (rs *RuleSet) Len() int {
+	return len(rs.rules)
+}
+
+// Result is the outcome of checking a body.
+type Result struct {
+	// Body is the body with every mask rule applied.
+	Body string
+	// Rejected names the rule that rejected the body, if any. Rules after
+	// it are not run.
+	Rejected string
+	// Flags names the flag rules that matched.
+	Flags []string
+}
+
+// Check runs every rule over body.
+func (rs *RuleSet) Check(body string) Result {
+	result := Result{Body: body}
+	for _, r := range rs.rules {
+		spans := r.match(result.Body)
+		if len(spans) == 0 {
+			continue
+		}
+		switch r.action {
+		case ActionMask:
+			result.Body = mask(result.Body, spans)
+		case ActionReject:
+			result.Rejected = r.name
+			return result
+		case ActionFlag:
+			result.Flags = append(result.Flags, r.name)
+		}
+	}
+	return result
+}
+
+// match returns the byte ranges of body that r matches, in order.
+func (r rule) match(body string) [][2]int {
+	if r.pattern != nil {
+		var spans [][2]int
+		for _, loc := range r.pattern.FindAllStringIndex(body, -1) {
+			if loc[0] < loc[1] {
+				spans = append(spans, [2]int{loc[0], loc[1]})
+			}
+		}
+		return spans
+	}
+
+	var spans [][2]int
+	for _, span := range wordSpans(body) {
+		if _, ok := r.words[fold(body[span[0]:span[1]])]; ok {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func mask(body string, spans [][2]int) string {
+	var b strings.Builder
+	last := 0
+	for _, span := range spans {
+		b.WriteString(body[last:span[0]])
+		b.WriteString(Mask)
+		last = span[1]
+	}
+	b.WriteString(body[last:])
+	return b.String()
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r)
+}
+
+// wordSpans splits s into runs of letters, digits and combining marks, so
+// "Kerfuffle!" and "«fornax»" are words with the punctuation left out.
+func wordSpans(s string) [][2]int {
+	var spans [][2]int
+	start := -1
+	for i, r := range s {
+		switch {
+		case isWordRune(r) && start < 0:
+			start = i
+		case !isWordRune(r) && start >= 0:
+			spans = append(spans, [2]int{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(s)})
+	}
+	return spans
+}
+
+// fold maps each rune of s to the smallest rune it is case-equivalent to,
+// so two words fold the same exactly when strings.EqualFold matches them.
+func fold(s string) string {
+	return strings.Map(func(r rune) rune {
+		folded := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			folded = min(folded, f)
+		}
+		return folded
+	}, s)
+}
+
+// Moderator holds the rules in use. Reload swaps in new rules without
+// blocking checks that are running.
+type Moderator struct {
+	path  string
+	rules atomic.Pointer[RuleSet]
+}
+
+// New loads the rules from path, or uses DefaultConfig if path is empty.
+func New(path string) (*Moderator, error) {
+	m := &Moderator{path: path}
+	err := m.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload reads the config file again. If it can't be loaded the rules in
+// use are kept.
+func (m *Moderator) Reload() error {
+	config := DefaultConfig
+	if m.path != "" {
+		var err error
+		config, err = LoadConfig(m.path)
+		if err != nil {
+			return err
+		}
+	}
+
+	rules, err := config.Compile()
+	if err != nil {
+		return err
+	}
+	m.rules.Store(rules)
+	return nil
+}
+
+// Rules returns the rules in use.
+func (m *Moderator) Rules() *RuleSet {
+	return m.rules.Load()
+}
+
+// Check runs the rules in use over body.
+func (m *Moderator) Check(body string) Result {
+	return m.Rules().Check(body)
+}
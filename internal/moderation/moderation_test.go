@@ -0,0 +1,94 @@
+package moderation
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	rules, err := Config{Rules: []RuleConfig{
+		{Name: "profanity", Words: []string{"kerfuffle", "Straße", "cafe\u0301"}, Action: ActionMask},
+		{Name: "links", Pattern: `https?://\S+`, Action: ActionFlag},
+		{Name: "shouting", Pattern: `[A-Z]{10,}`, Action: ActionFlag},
+		{Name: "slur", Words: []string{"fornax"}, Action: ActionReject},
+	}}.Compile()
+	if err != nil {
+		t.Fatalf("Compile resulted in an error: %v", err)
+	}
+
+	cases := []struct {
+		body string
+		want Result
+	}{
+		{"all fine", Result{Body: "all fine"}},
+		{"Kerfuffle! what a KERFUFFLE.", Result{Body: "****! what a ****."}},
+		{"kerfuffles are fine", Result{Body: "kerfuffles are fine"}},
+		{"«straße» and STRASSE", Result{Body: "«****» and STRASSE"}},
+		{"CAF\u00C9!", Result{Body: "****!"}},
+		{"see https://example.com NOWPLEASEOK", Result{Body: "see https://example.com NOWPLEASEOK", Flags: []string{"links", "shouting"}}},
+		{"kerfuffle, (Fornax) http://x", Result{Body: "****, (Fornax) http://x", Flags: []string{"links"}, Rejected: "slur"}},
+	}
+	for _, c := range cases {
+		if got := rules.Check(c.body); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Check(%q) = %+v, want %+v", c.body, got, c.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	configs := []Config{
+		{Rules: []RuleConfig{{Words: []string{"a"}, Action: ActionMask}}},
+		{Rules: []RuleConfig{{Name: "a", Words: []string{"a"}, Action: "ban"}}},
+		{Rules: []RuleConfig{{Name: "a", Action: ActionMask}}},
+		{Rules: []RuleConfig{{Name: "a", Words: []string{"a"}, Pattern: "a", Action: ActionMask}}},
+		{Rules: []RuleConfig{{Name: "a", Words: []string{"two words"}, Action: ActionMask}}},
+		{Rules: []RuleConfig{{Name: "a", Pattern: "(", Action: ActionMask}}},
+		{Rules: []RuleConfig{{Name: "a", Words: []string{"a"}, Action: ActionMask}, {Name: "a", Words: []string{"b"}, Action: ActionFlag}}},
+	}
+	for _, config := range configs {
+		if _, err := config.Compile(); err == nil {
+			t.Errorf("Expected %+v not to compile", config)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "moderation.json")
+	os.WriteFile(path, []byte(`{"rules":[{"name":"spam","words":["spam"],"action":"reject"}]}`), 0644)
+
+	m, err := New(path)
+	if err != nil {
+		t.Fatalf("New resulted in an error: %v", err)
+	}
+	if got := m.Check("Spam!"); got.Rejected != "spam" {
+		t.Errorf("Expected spam to be rejected, got %+v", got)
+	}
+
+	os.WriteFile(path, []byte(`{"rules":[{"name":"spam","words":["spam"],"action":"mask"}]}`), 0644)
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload resulted in an error: %v", err)
+	}
+	if got := m.Check("Spam!"); got.Body != "****!" || got.Rejected != "" {
+		t.Errorf("Expected spam to be masked after a reload, got %+v", got)
+	}
+
+	os.WriteFile(path, []byte(`{"rules":[{"name":"spam","word":["spam"],"action":"mask"}]}`), 0644)
+	if err := m.Reload(); err == nil {
+		t.Errorf("Expected a config with an unknown field not to load")
+	}
+	if got := m.Check("Spam!"); got.Body != "****!" {
+		t.Errorf("Expected a failed reload to keep the rules in use, got %+v", got)
+	}
+}
+
+func TestDefaultConfig(t *testing.T) {
+	m, err := New("")
+	if err != nil {
+		t.Fatalf("New resulted in an error: %v", err)
+	}
+	if got := m.Check("This is a Kerfuffle! Sharbert, fornax."); got.Body != "This is a ****! ****, ****." {
+		t.Errorf("Expected the default rules to mask the bad words, got %q", got.Body)
+	}
+}
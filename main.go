@@ -1,19 +1,29 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/joho/godotenv"
 	"github.com/rxmeez/chirpy/internal/database"
+	"github.com/rxmeez/chirpy/internal/moderation"
 )
 
 type apiConfig struct {
-	fileserverHits int
-	db             *database.DB
-	jwtSecret      string
-	polkaSecret    string
+	fileserverHits  int
+	db              database.Store
+	jwtSecret       string
+	polkaSecret     string
+	adminApiKey     string
+	backupDir       string
+	backupRetention int
+	moderator       *moderation.Moderator
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -27,8 +37,41 @@ func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 func main() {
 	const port string = "8080"
 	const filepathRoot string = "./app"
+
+	migrateOnly := flag.Bool("migrate-only", false, "apply pending database migrations and exit")
+	dryRun := flag.Bool("dry-run", false, "with --migrate-only, report pending migrations without applying them")
+	flag.Parse()
+
 	godotenv.Load(".env")
 
+	dbCfg, err := dbConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *migrateOnly {
+		runMigrations(dbCfg, *dryRun)
+		return
+	}
+
+	if flag.Arg(0) == "restore" {
+		if flag.NArg() != 2 {
+			log.Fatal("usage: chirpy restore <file>")
+		}
+		runRestore(dbCfg, flag.Arg(1))
+		return
+	}
+
+	backupCfg, err := backupConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sweepInterval, err := sessionSweepIntervalFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	jwtSecret := os.Getenv("JWT_SECRET")
 	if jwtSecret == "" {
 		log.Fatal("JWT_SECRET environment variable is not set")
@@ -39,11 +82,36 @@ func main() {
 		log.Fatal("JWT_SECRET environment variable is not set")
 	}
 
-	db, err := database.NewDB("./database.json")
+	// MODERATION_CONFIG names a JSON rules file; see moderation.Config.
+	// Without it the built-in rules are used.
+	moderator, err := moderation.New(os.Getenv("MODERATION_CONFIG"))
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Couldn't load moderation rules: %v", err)
+	}
+
+	// Refresh tokens are stored under a key of their own, so the JWT secret
+	// can be rotated without signing every device out. The store refuses
+	// to open with a different key than it was keyed with.
+	refreshTokenSecret := os.Getenv("REFRESH_TOKEN_SECRET")
+	if refreshTokenSecret == "" {
+		log.Fatal("REFRESH_TOKEN_SECRET environment variable is not set")
+	}
+	dbCfg.opts.TokenKey = []byte(refreshTokenSecret)
+
+	db, err := database.Open(dbCfg.driver, dbCfg.path, dbCfg.opts)
+	if err != nil {
+		log.Fatalf("Couldn't open database: %v", err)
+	}
+	apiCfg := apiConfig{
+		fileserverHits:  0,
+		db:              db,
+		jwtSecret:       jwtSecret,
+		polkaSecret:     polkaSecret,
+		adminApiKey:     os.Getenv("ADMIN_API_KEY"),
+		backupDir:       backupCfg.dir,
+		backupRetention: backupCfg.retention,
+		moderator:       moderator,
 	}
-	apiCfg := apiConfig{fileserverHits: 0, db: db, jwtSecret: jwtSecret, polkaSecret: polkaSecret}
 
 	mux := http.NewServeMux()
 	fsHandler := apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot))))
@@ -56,16 +124,39 @@ func main() {
 
 	mux.HandleFunc("POST /api/users", apiCfg.handlerUsersCreate)
 	mux.HandleFunc("PUT /api/users", apiCfg.handlerUsersUpdate)
+	mux.HandleFunc("GET /api/users/{id}/mentions", apiCfg.handlerUserMentions)
+	mux.HandleFunc("POST /api/users/{id}/follow", apiCfg.handlerUserFollow)
+	mux.HandleFunc("DELETE /api/users/{id}/follow", apiCfg.handlerUserUnfollow)
+	mux.HandleFunc("GET /api/users/{id}/followers", apiCfg.handlerUserFollowers)
+	mux.HandleFunc("GET /api/users/{id}/following", apiCfg.handlerUserFollowing)
+	mux.HandleFunc("GET /api/timeline", apiCfg.handlerTimeline)
 
 	mux.HandleFunc("POST /api/refresh", apiCfg.handlerRefreshToken)
 	mux.HandleFunc("POST /api/revoke", apiCfg.handlerRevokeToken)
+	mux.HandleFunc("POST /api/logout-all", apiCfg.handlerLogoutAll)
+	mux.HandleFunc("GET /api/sessions", apiCfg.handlerSessionsList)
+	mux.HandleFunc("DELETE /api/sessions/{id}", apiCfg.handlerSessionRevoke)
 
 	mux.HandleFunc("POST /api/chirps", apiCfg.handlerChirpsCreate)
 	mux.HandleFunc("GET /api/chirps/", apiCfg.handlerChirpsRetrieve)
+	mux.HandleFunc("GET /api/chirps/search", apiCfg.handlerChirpsSearch)
 	mux.HandleFunc("GET /api/chirps/{id}", apiCfg.handlerChirpRetrieveId)
+	mux.HandleFunc("GET /api/chirps/{id}/thread", apiCfg.handlerChirpThread)
+	mux.HandleFunc("GET /api/chirps/{id}/revisions", apiCfg.handlerChirpRevisions)
+	mux.HandleFunc("PUT /api/chirps/{id}", apiCfg.handlerChirpUpdate)
 	mux.HandleFunc("DELETE /api/chirps/{id}", apiCfg.handlerChirpDeleteId)
+	mux.HandleFunc("POST /api/chirps/{id}/rechirp", apiCfg.handlerChirpRechirp)
+	mux.HandleFunc("POST /api/chirps/{id}/like", apiCfg.handlerChirpLike)
+	mux.HandleFunc("DELETE /api/chirps/{id}/like", apiCfg.handlerChirpUnlike)
+
+	mux.HandleFunc("GET /api/hashtags/trending", apiCfg.handlerHashtagsTrending)
+	mux.HandleFunc("GET /api/hashtags/{tag}/chirps", apiCfg.handlerHashtagChirps)
 
 	mux.HandleFunc("GET /admin/metrics", apiCfg.handlerMetrics)
+	mux.HandleFunc("POST /admin/backup", apiCfg.handlerAdminBackup)
+	mux.HandleFunc("POST /admin/moderation/reload", apiCfg.handlerModerationReload)
+	mux.HandleFunc("GET /admin/moderation/flags", apiCfg.handlerModerationFlags)
+	mux.HandleFunc("DELETE /admin/moderation/flags/{id}", apiCfg.handlerModerationDismiss)
 
 	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.handlerUsersUpgrade)
 
@@ -74,6 +165,76 @@ func main() {
 		Handler: mux,
 	}
 
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			err := moderator.Reload()
+			if err != nil {
+				log.Printf("Couldn't reload moderation rules, keeping the old ones: %v", err)
+				continue
+			}
+			log.Printf("Reloaded %d moderation rules", moderator.Rules().Len())
+		}
+	}()
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		server.Shutdown(context.Background())
+	}()
+
+	sweepCtx, stopSweeping := context.WithCancel(context.Background())
+	sweeperDone := make(chan struct{})
+	go func() {
+		defer close(sweeperDone)
+		sweepSessions(sweepCtx, db, sweepInterval)
+	}()
+
 	log.Printf("Serving files from %s on port: %s\n", filepathRoot, port)
-	log.Fatal(server.ListenAndServe())
+	err = server.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	stopSweeping()
+	<-sweeperDone
+
+	err = db.Close()
+	if err != nil {
+		log.Fatalf("Couldn't close database: %v", err)
+	}
+}
+
+func runMigrations(dbCfg dbConfig, dryRun bool) {
+	steps, err := database.Migrate(dbCfg.driver, dbCfg.path, dryRun)
+	if err != nil {
+		log.Fatalf("Couldn't migrate database: %v", err)
+	}
+
+	if len(steps) == 0 {
+		log.Printf("%s is up to date", dbCfg.path)
+		return
+	}
+
+	verb := "Applied"
+	if dryRun {
+		verb = "Would apply"
+	}
+	for _, step := range steps {
+		log.Printf("%s migration %s", verb, step)
+	}
+}
+
+func runRestore(dbCfg dbConfig, file string) {
+	err := database.Restore(dbCfg.driver, file, dbCfg.path)
+	if err != nil {
+		log.Fatalf("Couldn't restore %s: %v", file, err)
+	}
+
+	log.Printf("Restored %s from %s", dbCfg.path, file)
+	if dbCfg.opts.Mode == database.ModeDev {
+		log.Printf("DB_MODE=dev wipes the database on start; unset it to keep the restored data")
+	}
 }
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// logSecurityEvent records something an operator may need to act on, such
+// as a replayed refresh token. Events go to the log on one line starting
+// with "security event=", so they are easy to alert on.
+func logSecurityEvent(r *http.Request, event string, userId int, sessionId int) {
+	log.Printf("security event=%s user_id=%d session_id=%d remote_addr=%s user_agent=%q",
+		event, userId, sessionId, r.RemoteAddr, r.UserAgent())
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/rxmeez/chirpy/internal/database"
+)
+
+// sweepSessions purges expired sessions on start and then every interval,
+// until ctx is done. Expired refresh tokens are rejected either way; this
+// only keeps them from piling up in the store.
+func sweepSessions(ctx context.Context, db database.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := db.PurgeExpiredSessions()
+		if err != nil {
+			log.Printf("Couldn't purge expired sessions: %v", err)
+		} else if n > 0 {
+			log.Printf("Purged %d expired sessions", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}